@@ -15,14 +15,27 @@
 package main
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+)
 
-	"golang.org/x/build/gerrit"
+const (
+	// OAuth2 tokens are refreshed this long before they expire.
+	tokenExpiryMargin = 30 * time.Second
 )
 
 var (
@@ -37,15 +50,53 @@ type authManager struct {
 	password   string
 	digest     bool
 	credsPath_ string
+
+	token        string
+	tokenExpiry  time.Time
+	tokenUrl     string
+	clientId     string
+	clientSecret string
+	// tokenClient is used to request tokens from tokenUrl.
+	tokenClient       *http.Client
+	headerConfigPath_ string
+
+	caCerts         string
+	caCertsPath_    string
+	clientCert      string
+	clientCertPath_ string
+	clientKey       string
+	clientKeyPath_  string
+	proxy           string
+	noProxy         string
+
+	privateKey      string
+	privateKeyPath_ string
+	knownHosts      string
+	knownHostsPath_ string
 }
 
 func newAuthManager(source Source) *authManager {
-	return &authManager{
-		cookies:  source.Cookies,
-		username: source.Username,
-		password: source.Password,
-		digest:   source.DigestAuth,
+	am := &authManager{
+		cookies:      source.Cookies,
+		username:     source.Username,
+		password:     source.Password,
+		digest:       source.DigestAuth,
+		tokenUrl:     source.TokenUrl,
+		clientId:     source.ClientId,
+		clientSecret: source.ClientSecret,
+		tokenClient:  http.DefaultClient,
+		caCerts:      source.CaCerts,
+		clientCert:   source.ClientCert,
+		clientKey:    source.ClientKey,
+		proxy:        source.Proxy,
+		noProxy:      source.NoProxy,
+		privateKey:   source.PrivateKey,
+		knownHosts:   source.KnownHosts,
+	}
+	if am.tokenUrl == "" {
+		am.token = source.Token
 	}
+	return am
 }
 
 func (am *authManager) cookiesPath() (string, error) {
@@ -79,25 +130,172 @@ func (am *authManager) credsPath() (string, error) {
 	return am.credsPath_, err
 }
 
-func (am *authManager) gerritAuth() (gerrit.Auth, error) {
+func (am *authManager) privateKeyPath() (string, error) {
+	if am.privateKey == "" {
+		return "", nil
+	}
+	var err error
+	if am.privateKeyPath_ == "" {
+		// ssh requires a trailing newline and refuses keys readable by others;
+		// temp files are created with mode 0600.
+		am.privateKeyPath_, err = writeAuthTempFile(
+			"concourse-gerrit-key", strings.TrimSpace(am.privateKey)+"\n")
+	}
+	return am.privateKeyPath_, err
+}
+
+func (am *authManager) knownHostsPath() (string, error) {
+	if am.knownHosts == "" {
+		return "", nil
+	}
+	var err error
+	if am.knownHostsPath_ == "" {
+		am.knownHostsPath_, err = writeAuthTempFile(
+			"concourse-gerrit-known-hosts", am.knownHosts)
+	}
+	return am.knownHostsPath_, err
+}
+
+// headerConfigPath returns the path of a git config file setting the
+// Authorization header for bearer token auth. Including it from the
+// repository's config keeps the token out of the repository itself.
+func (am *authManager) headerConfigPath(ctx context.Context) (string, error) {
+	if !am.bearer() {
+		return "", nil
+	}
+	token, err := am.bearerToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(token, "\x00\n") {
+		return "", errors.New("invalid character in token")
+	}
+	if am.headerConfigPath_ == "" {
+		am.headerConfigPath_, err = writeAuthTempFile(
+			"concourse-gerrit-header",
+			fmt.Sprintf("[http]\n\textraHeader = %s\n",
+				strconv.Quote("Authorization: Bearer "+token)))
+	}
+	return am.headerConfigPath_, err
+}
+
+// sshArgs returns ssh command options for the private key and known hosts.
+// Host keys are always checked strictly.
+func (am *authManager) sshArgs() ([]string, error) {
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+	}
+
+	privateKeyPath, err := am.privateKeyPath()
+	if err != nil {
+		return nil, err
+	}
+	if privateKeyPath != "" {
+		args = append(args, "-i", privateKeyPath, "-o", "IdentitiesOnly=yes")
+	}
+
+	knownHostsPath, err := am.knownHostsPath()
+	if err != nil {
+		return nil, err
+	}
+	if knownHostsPath != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+knownHostsPath)
+	}
+
+	return args, nil
+}
+
+// gitEnv returns environment variables for git commands which connect to the
+// remote. Fetching over ssh uses the private key and known hosts.
+func (am *authManager) gitEnv() ([]string, error) {
+	args, err := am.sshArgs()
+	if err != nil {
+		return nil, err
+	}
+	quoted := []string{"ssh"}
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return []string{"GIT_SSH_COMMAND=" + strings.Join(quoted, " ")}, nil
+}
+
+// authenticated reports whether requests should use Gerrit's authenticated
+// "/a" REST endpoints.
+func (am *authManager) authenticated() bool {
+	return am.username != "" || am.cookies != "" || am.bearer()
+}
+
+// bearer reports whether requests use OAuth2 bearer token auth.
+func (am *authManager) bearer() bool {
+	return am.token != "" || am.tokenUrl != ""
+}
+
+// bearerToken returns the bearer token, requesting a new one from tokenUrl
+// if there isn't one yet or it is about to expire.
+func (am *authManager) bearerToken(ctx context.Context) (string, error) {
+	if am.tokenUrl == "" {
+		return am.token, nil
+	}
+	if am.token != "" && (am.tokenExpiry.IsZero() || time.Now().Before(am.tokenExpiry)) {
+		return am.token, nil
+	}
+
+	token, expiresIn, err := requestToken(
+		ctx, am.tokenClient, am.tokenUrl, am.clientId, am.clientSecret)
+	if err != nil {
+		return "", fmt.Errorf("error requesting token: %v", err)
+	}
+	am.token = token
+	am.tokenExpiry = time.Time{}
+	if expiresIn > 0 {
+		am.tokenExpiry = time.Now().Add(expiresIn - tokenExpiryMargin)
+	}
+	return am.token, nil
+}
+
+// expireToken discards a token requested from tokenUrl so the next request
+// gets a new one. It reports whether there was such a token.
+func (am *authManager) expireToken() bool {
+	if am.tokenUrl == "" || am.token == "" {
+		return false
+	}
+	am.token = ""
+	return true
+}
+
+// setRequestAuth adds credentials to a REST request. For digest auth, challenge is the WWW-Authenticate header
+// from a previous response to the same request.
+func (am *authManager) setRequestAuth(req *http.Request, challenge string) error {
 	if am.username != "" {
-		if am.digest {
-			return gerrit.DigestAuth(am.username, am.password), nil
-		} else {
-			return gerrit.BasicAuth(am.username, am.password), nil
+		if !am.digest {
+			req.SetBasicAuth(am.username, am.password)
+		} else if challenge != "" {
+			authz, err := digestAuthorization(
+				am.username, am.password, req.Method, req.URL.RequestURI(), challenge)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", authz)
 		}
 	} else if am.cookies != "" {
-		cookiesPath, err := am.cookiesPath()
+		for _, cookie := range parseCookies(am.cookies) {
+			if cookieMatches(cookie, req) {
+				req.AddCookie(cookie)
+			}
+		}
+	} else if am.bearer() {
+		token, err := am.bearerToken(req.Context())
 		if err != nil {
-			return nil, err
+			return err
 		}
-		return gerrit.GitCookieFileAuth(cookiesPath), nil
-	} else {
-		return gerrit.NoAuth, nil
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
+	return nil
 }
 
-func (am *authManager) gitConfigArgs() (map[string]string, error) {
+// gitConfigArgs returns git config settings for fetching from fetchUrl.
+func (am *authManager) gitConfigArgs(fetchUrl string) (map[string]string, error) {
 	args := make(map[string]string)
 
 	if am.username != "" {
@@ -117,11 +315,31 @@ func (am *authManager) gitConfigArgs() (map[string]string, error) {
 		args["http.cookieFile"] = cookiesPath
 	}
 
+	if am.bearer() {
+		headerConfigPath, err := am.headerConfigPath(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		args["include.path"] = headerConfigPath
+	}
+
+	tlsArgs, err := am.gitTlsConfigArgs(fetchUrl)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range tlsArgs {
+		args[key] = value
+	}
+
 	return args, nil
 }
 
 func (am *authManager) cleanup() {
-	for _, path := range []*string{&am.cookiesPath_, &am.credsPath_} {
+	for _, path := range []*string{
+		&am.cookiesPath_, &am.credsPath_, &am.headerConfigPath_,
+		&am.caCertsPath_, &am.clientCertPath_, &am.clientKeyPath_,
+		&am.privateKeyPath_, &am.knownHostsPath_,
+	} {
 		if *path != "" {
 			err := os.Remove(*path)
 			if err != nil {
@@ -139,6 +357,11 @@ func (am *authManager) cleanup() {
 	}
 }
 
+// shellQuote quotes an argument for sh.
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
 func writeAuthTempFile(suffix string, contents string) (string, error) {
 	f, err := ioutil.TempFile(authTempDir, suffix)
 	if err != nil {
@@ -153,3 +376,190 @@ func writeAuthTempFile(suffix string, contents string) (string, error) {
 
 	return f.Name(), nil
 }
+
+// parseCookies parses cookies in "Netscape cookie file format", leaving out
+// expired cookies.
+func parseCookies(data string) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, line := range strings.Split(data, "\n") {
+		// Lines prefixed with "#HttpOnly_" are cookies; other "#" lines are comments.
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		f := strings.Split(line, "\t")
+		if strings.HasPrefix(line, "#") || len(f) < 7 {
+			continue
+		}
+		cookie := &http.Cookie{
+			Domain: f[0],
+			Path:   f[2],
+			Secure: f[3] == "TRUE",
+			Name:   f[5],
+			Value:  f[6],
+		}
+		// An expiry of 0 means a session cookie.
+		if expiry, err := strconv.ParseInt(f[4], 10, 64); err == nil && expiry > 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+			if cookie.Expires.Before(time.Now()) {
+				continue
+			}
+		}
+		cookies = append(cookies, cookie)
+	}
+	return cookies
+}
+
+func cookieMatches(cookie *http.Cookie, req *http.Request) bool {
+	host := req.URL.Hostname()
+	domain := strings.TrimPrefix(cookie.Domain, ".")
+	if host != domain && !strings.HasSuffix(host, "."+domain) {
+		return false
+	}
+	if cookie.Secure && req.URL.Scheme != "https" {
+		return false
+	}
+	return strings.HasPrefix(req.URL.Path, cookie.Path)
+}
+
+// requestToken requests an OAuth2 access token with the client credentials
+// grant, returning the token and its lifetime (zero if unknown).
+// See: https://tools.ietf.org/html/rfc6749#section-4.4
+func requestToken(
+	ctx context.Context,
+	client *http.Client,
+	tokenUrl string,
+	clientId string,
+	clientSecret string,
+) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest("POST", tokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// See: https://tools.ietf.org/html/rfc6749#section-2.3.1
+	req.SetBasicAuth(url.QueryEscape(clientId), url.QueryEscape(clientSecret))
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return "", 0, fmt.Errorf("HTTP status %s; %s", resp.Status, body)
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return "", 0, err
+	}
+	if tokenResp.AccessToken == "" {
+		return "", 0, errors.New("no access_token in response")
+	}
+	if tokenResp.TokenType != "" && !strings.EqualFold(tokenResp.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported token_type %q", tokenResp.TokenType)
+	}
+	return tokenResp.AccessToken, time.Duration(tokenResp.ExpiresIn) * time.Second, nil
+}
+
+// digestAuthorization builds an Authorization header value responding to a
+// Digest WWW-Authenticate challenge.
+// See: https://tools.ietf.org/html/rfc2617#section-3.2.2
+func digestAuthorization(username, password, method, uri, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Digest ") {
+		return "", fmt.Errorf("unsupported auth challenge %q", challenge)
+	}
+	params := parseAuthParams(strings.TrimPrefix(challenge, "Digest "))
+	qop := ""
+	if params["qop"] != "" {
+		for _, option := range strings.Split(params["qop"], ",") {
+			if strings.TrimSpace(option) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return "", fmt.Errorf("unsupported digest qop %q", params["qop"])
+		}
+	}
+
+	cnonceBytes := make([]byte, 8)
+	_, err := rand.Read(cnonceBytes)
+	if err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(cnonceBytes)
+	nc := "00000001"
+
+	ha1 := md5Hex(username + ":" + params["realm"] + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	var response string
+	if qop != "" {
+		response = md5Hex(strings.Join(
+			[]string{ha1, params["nonce"], nc, cnonce, qop, ha2}, ":"))
+	} else {
+		response = md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	}
+
+	authz := fmt.Sprintf(
+		`Digest username=%s, realm=%s, nonce=%s, uri=%s, response=%s`,
+		strconv.Quote(username), strconv.Quote(params["realm"]),
+		strconv.Quote(params["nonce"]), strconv.Quote(uri), strconv.Quote(response))
+	if params["opaque"] != "" {
+		authz += fmt.Sprintf(", opaque=%s", strconv.Quote(params["opaque"]))
+	}
+	if qop != "" {
+		authz += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+	return authz, nil
+}
+
+// parseAuthParams parses the comma separated key=value pairs of an auth
+// challenge. Values may be quoted strings containing commas and
+// backslash-escaped characters.
+// See: https://tools.ietf.org/html/rfc7235#section-2.1
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, ", \t")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return params
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++ // closing quote
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(strings.TrimSpace(s[:end]))
+			s = s[end:]
+		}
+		params[key] = value.String()
+	}
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// responseCache stores Gerrit API responses with ETags so they can be
+// revalidated with conditional requests instead of downloaded again.
+type responseCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+	// used tracks entries used since loading; only these are saved.
+	used map[string]bool
+}
+
+type cachedResponse struct {
+	ETag string `json:"etag"`
+	Body []byte `json:"body"`
+}
+
+func responseCacheFilename(src Source) string {
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%#v", src)
+	hashed := base32.StdEncoding.EncodeToString(hash.Sum([]byte{}))
+	return filepath.Join(
+		updateStampTempDir,
+		fmt.Sprintf("concourse-gerrit-%s.cache", hashed))
+}
+
+// loadResponseCache reads the response cache for a source from disk. A
+// missing or unreadable cache file results in an empty cache.
+func loadResponseCache(src Source) (*responseCache, error) {
+	cache := &responseCache{
+		path:    responseCacheFilename(src),
+		entries: make(map[string]*cachedResponse),
+		used:    make(map[string]bool),
+	}
+	f, err := os.Open(cache.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = fmt.Errorf("error opening response cache file: %v", err)
+		}
+		return cache, err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&cache.entries)
+	if err != nil {
+		cache.entries = make(map[string]*cachedResponse)
+		return cache, fmt.Errorf("error reading response cache file: %v", err)
+	}
+	return cache, nil
+}
+
+// save writes the cache entries used since loading to disk.
+func (rc *responseCache) save() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	entries := make(map[string]*cachedResponse)
+	for key := range rc.used {
+		if entry, ok := rc.entries[key]; ok {
+			entries[key] = entry
+		}
+	}
+
+	// Concurrent checks of the same source share the cache file, so it is
+	// replaced rather than rewritten in place.
+	f, err := ioutil.TempFile(filepath.Dir(rc.path), filepath.Base(rc.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating response cache file: %v", err)
+	}
+	err = json.NewEncoder(f).Encode(entries)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), rc.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error writing response cache file: %v", err)
+	}
+	return nil
+}
+
+func (rc *responseCache) get(key string) *cachedResponse {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.used[key] = true
+	return rc.entries[key]
+}
+
+func (rc *responseCache) put(key string, entry *cachedResponse) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.used[key] = true
+	rc.entries[key] = entry
+}
+
+// cachingTransport sends If-None-Match with GET requests for cached
+// responses, replacing "304 Not Modified" responses with the cached ones.
+type cachingTransport struct {
+	cache *responseCache
+	base  http.RoundTripper
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return t.base.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+	cached := t.cache.get(key)
+	if cached != nil {
+		// RoundTrippers must not modify the given request.
+		req = req.WithContext(req.Context())
+		req.Header = cloneHeader(req.Header)
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		resp.Body.Close()
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+		resp.Body = ioutil.NopCloser(bytes.NewReader(cached.Body))
+		resp.ContentLength = int64(len(cached.Body))
+		return resp, nil
+	}
+
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode == http.StatusOK && etag != "" {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		t.cache.put(key, &cachedResponse{ETag: etag, Body: body})
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return resp, nil
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
@@ -51,6 +51,11 @@ func check(req resource.CheckRequest) error {
 		return err
 	}
 
+	err = validateFooterRules(src)
+	if err != nil {
+		return err
+	}
+
 	authMan := newAuthManager(src)
 	defer authMan.cleanup()
 
@@ -59,11 +64,27 @@ func check(req resource.CheckRequest) error {
 		return fmt.Errorf("error setting up gerrit client: %v", err)
 	}
 
+	// Cache responses between checks to make conditional requests.
+	if api, ok := c.(*gerritApi); ok {
+		cache, err := loadResponseCache(src)
+		if err != nil {
+			log.Println(err)
+		}
+		api.useCache(cache)
+		defer func() {
+			err := cache.save()
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
 	// Setup Gerrit query
-	query := src.Query
-	if query == "" {
-		query = defaultQuery
+	baseQuery := src.Query
+	if baseQuery == "" {
+		baseQuery = defaultQuery
 	}
+	query := baseQuery
 
 	var afterTime time.Time
 
@@ -99,10 +120,17 @@ func check(req resource.CheckRequest) error {
 		wantRequestedVersion = true
 	}
 
+	if src.GroupBy != "" {
+		// Grouped versions are made up of current revisions only.
+		queryOpt.Fields = []string{"CURRENT_REVISION"}
+	}
+	extraFields := checkExtraFields(src)
+	queryOpt.Fields = append(queryOpt.Fields, extraFields...)
+
 	log.Printf("query: %q %+v", query, queryOpt)
 
 	ctx := context.Background()
-	changes, err := c.QueryChanges(ctx, query, queryOpt)
+	changes, err := c.queryChanges(ctx, query, queryOpt)
 	if err != nil {
 		return fmt.Errorf("error querying for changes: %v", err)
 	}
@@ -121,28 +149,62 @@ func check(req resource.CheckRequest) error {
 
 	// Translate Gerrit changes into Versions
 	versions := VersionList{}
-	for _, change := range changes {
-		for revision, revisionInfo := range change.Revisions {
-			include := false
-			created := revisionInfo.Created.Time()
-			if wantRequestedVersion && change.ID == ver.ChangeId && revision == ver.Revision {
-				include = true
+	if src.GroupBy == "" {
+		for _, change := range changes {
+			for revision, revisionInfo := range change.Revisions {
+				if wantRequestedVersion && change.ID == ver.ChangeId && revision == ver.Revision {
+					// Return the requested version as given, which may be missing
+					// fields added since it was created.
+					versions = append(versions, ver)
+					wantRequestedVersion = false
+				} else if revisionInfo.Created.Time().After(afterTime) &&
+					!skipRevision(c, ctx, src, change, revision) {
+					versions = append(versions, newVersion(change, revision))
+				}
+			}
+		}
+	} else {
+		// Members may leave the requested group (e.g. by being abandoned or
+		// merged) without its other members being updated, so those are
+		// regrouped too.
+		var requestedChanges []*changeInfo
+		if ver.Members != "" {
+			requestedChanges, err = requestedGroupChanges(c, ctx, ver, queryOpt.Fields)
+			if err != nil {
+				return err
+			}
+			for _, change := range requestedChanges {
+				if change.Status == "NEW" {
+					changes = append(changes, change)
+				}
+			}
+		}
+
+		groupVers, groupChanges, err := groupVersions(c, ctx, src, baseQuery, changes, extraFields)
+		if err != nil {
+			return err
+		}
+		for _, groupVer := range groupVers {
+			if wantRequestedVersion && groupVer.Group == ver.Group && groupVer.Members == ver.Members {
+				versions = append(versions, ver)
 				wantRequestedVersion = false
-			} else {
-				include = created.After(afterTime)
+				continue
+			}
+			changed := groupChanged(groupVer, ver)
+			if changed {
+				// The newest member revision may be older than the requested
+				// version, which this must come after.
+				groupVer.Created = groupUpdated(groupVer, groupChanges, requestedChanges)
 			}
-			if include {
-				versions = append(versions, Version{
-					ChangeId: change.ID,
-					Revision: revision,
-					Created:  created,
-				})
+			if (changed || groupVer.Created.After(afterTime)) &&
+				!skipGroup(c, ctx, src, groupVer, groupChanges) {
+				versions = append(versions, groupVer)
 			}
 		}
 	}
 	if wantRequestedVersion {
 		// Confirm the requested version still exists
-		_, _, err := getVersionChangeRevision(c, ctx, ver)
+		err := confirmVersion(c, ctx, ver)
 		if err == nil {
 			versions = append(versions, ver)
 		} else {
@@ -15,7 +15,11 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -46,6 +50,19 @@ func TestCheckSourceCookies(t *testing.T) {
 	assert.Equal(t, "bar", cookie.Value)
 }
 
+func TestParseCookiesExpiry(t *testing.T) {
+	cookies := parseCookies(strings.Join([]string{
+		"localhost\tFALSE\t/\tFALSE\t9999999999\tfuture\ta",
+		"localhost\tFALSE\t/\tFALSE\t1000\texpired\tb",
+		"localhost\tFALSE\t/\tFALSE\t0\tsession\tc",
+	}, "\n"))
+	var names []string
+	for _, cookie := range cookies {
+		names = append(names, cookie.Name)
+	}
+	assert.Equal(t, []string{"future", "session"}, names)
+}
+
 func TestCheckSourceUsernamePassword(t *testing.T) {
 	testCheck(t, Source{Username: "bob", Password: "dog"}, Version{})
 	assert.True(t, testGerritLastAuthenticated)
@@ -60,6 +77,96 @@ func TestCheckSourceDigestAuth(t *testing.T) {
 	assert.Contains(t, authHeader, "Digest ")
 }
 
+func TestParseAuthParams(t *testing.T) {
+	assert.Equal(t, map[string]string{
+		"realm":     "Gerrit, Inc.",
+		"qop":       "auth,auth-int",
+		"nonce":     `a"b`,
+		"algorithm": "MD5",
+	}, parseAuthParams(`realm="Gerrit, Inc.", qop="auth,auth-int", nonce="a\"b",algorithm=MD5`))
+}
+
+func TestDigestAuthorizationQop(t *testing.T) {
+	authz, err := digestAuthorization("bob", "dog", "GET", "/a/changes/",
+		`Digest realm="Gerrit", nonce="foobar", qop="auth,auth-int"`)
+	if assert.NoError(t, err) {
+		assert.Contains(t, authz, `realm="Gerrit"`)
+		assert.Contains(t, authz, ", qop=auth,")
+	}
+
+	_, err = digestAuthorization("bob", "dog", "GET", "/a/changes/",
+		`Digest realm="Gerrit", nonce="foobar", qop="auth-int"`)
+	assert.Error(t, err)
+}
+
+func TestCheckSourceToken(t *testing.T) {
+	testCheck(t, Source{Token: "secret"}, Version{})
+	assert.True(t, testGerritLastAuthenticated)
+	assert.Equal(t, "Bearer secret", testGerritLastRequest.Header.Get("Authorization"))
+}
+
+func TestCheckSourceTokenUrl(t *testing.T) {
+	testTokenRequests = 0
+	testCheck(t, Source{
+		TokenUrl:     testGerritUrl + "/token",
+		ClientId:     "testclient",
+		ClientSecret: "testsecret",
+	}, Version{})
+	assert.True(t, testGerritLastAuthenticated)
+	assert.Equal(t, "Bearer testtoken1", testGerritLastRequest.Header.Get("Authorization"))
+	assert.Equal(t, 1, testTokenRequests)
+}
+
+func TestCheckSourceTokenRevoked(t *testing.T) {
+	testTokenRequests = 0
+	testGerritRevokedToken = "testtoken1"
+	defer func() { testGerritRevokedToken = "" }()
+
+	testCheck(t, Source{
+		TokenUrl:     testGerritUrl + "/token",
+		ClientId:     "testclient",
+		ClientSecret: "testsecret",
+	}, Version{})
+	assert.Equal(t, "Bearer testtoken2", testGerritLastRequest.Header.Get("Authorization"))
+	assert.Equal(t, 2, testTokenRequests)
+}
+
+func TestBearerTokenRefresh(t *testing.T) {
+	testTokenRequests = 0
+	testTokenExpiresIn = 3600
+	defer func() { testTokenExpiresIn = 0 }()
+
+	authMan := newAuthManager(Source{
+		TokenUrl:     testGerritUrl + "/token",
+		ClientId:     "testclient",
+		ClientSecret: "testsecret",
+	})
+	ctx := context.Background()
+	token, err := authMan.bearerToken(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "testtoken1", token)
+	token, err = authMan.bearerToken(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "testtoken1", token)
+
+	// Expired tokens are refreshed.
+	authMan.tokenExpiry = time.Now().Add(-time.Second)
+	token, err = authMan.bearerToken(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "testtoken2", token)
+	assert.Equal(t, 2, testTokenRequests)
+}
+
+func TestBearerTokenBadClient(t *testing.T) {
+	authMan := newAuthManager(Source{
+		TokenUrl:     testGerritUrl + "/token",
+		ClientId:     "testclient",
+		ClientSecret: "wrong",
+	})
+	_, err := authMan.bearerToken(context.Background())
+	assert.Error(t, err)
+}
+
 func TestCheckWithoutVersion(t *testing.T) {
 	versions := testCheck(t, Source{}, Version{})
 	assert.Equal(t, "status:open", testGerritLastQ)
@@ -69,6 +176,33 @@ func TestCheckWithoutVersion(t *testing.T) {
 	assert.Equal(t, "testproject~testbranch~Itestchange1", versions[0].ChangeId)
 	assert.Equal(t, "deadbeef0", versions[0].Revision)
 	assert.True(t, time.Unix(100, 0).Equal(versions[0].Created))
+	assert.Equal(t, 1, versions[0].ChangeNumber)
+	assert.Equal(t, 1, versions[0].PatchSet)
+	assert.Equal(t, "testproject", versions[0].Project)
+	assert.Equal(t, "testbranch", versions[0].Branch)
+}
+
+func TestCheckKeepsOldRequestedVersion(t *testing.T) {
+	// Versions created before change_number etc. were added are returned
+	// unchanged so Concourse still recognizes them.
+	ver := Version{
+		ChangeId: "testproject~testbranch~Itestchange1",
+		Revision: "deadbeef0",
+		Created:  time.Unix(100, 0),
+	}
+	versions := testCheck(t, Source{}, ver)
+	found := false
+	for _, version := range versions {
+		if version.ChangeId == ver.ChangeId && version.Revision == ver.Revision {
+			found = true
+			assert.Equal(t, 0, version.ChangeNumber)
+			assert.Equal(t, "", version.Project)
+		} else {
+			assert.NotZero(t, version.ChangeNumber)
+			assert.NotZero(t, version.PatchSet)
+		}
+	}
+	assert.True(t, found)
 }
 
 func TestCheckWithNewVersions(t *testing.T) {
@@ -137,3 +271,275 @@ func TestCheckTimestampCaching(t *testing.T) {
 	})
 	assert.Equal(t, "(bar) AND after:{1970-01-01 00:01:40}", testGerritLastQ)
 }
+
+func TestCheckGroupByTopic(t *testing.T) {
+	versions := testCheck(t, Source{GroupBy: "topic"}, Version{})
+	assert.Equal(t, `(status:open) AND topic:"testtopic"`, testGerritLastQ)
+
+	assert.Len(t, versions, 1)
+	assert.Equal(t, "topic:testtopic", versions[0].Group)
+	assert.Equal(t, "testproject~testbranch~Itestchange3", versions[0].ChangeId)
+	assert.True(t, time.Unix(300, 0).Equal(versions[0].Created))
+
+	members, err := versions[0].groupMembers()
+	assert.NoError(t, err)
+	assert.Len(t, members, 3)
+	assert.Equal(t, "testproject~testbranch~Itestchange1", members[0].ChangeId)
+	assert.Equal(t, "deadbeef0", members[0].Revision)
+}
+
+func TestCheckGroupByRelationChain(t *testing.T) {
+	versions := testCheck(t, Source{GroupBy: "relation_chain"}, Version{})
+	assert.Equal(t, "(status:open) AND (change:3 OR change:2 OR change:1)", testGerritLastQ)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, "relation_chain:1", versions[0].Group)
+
+	members, err := versions[0].groupMembers()
+	assert.NoError(t, err)
+	assert.Len(t, members, 3)
+	// Every change is in the chain at patch set 1, not at its current revision.
+	for _, member := range members {
+		assert.Equal(t, "deadbeef0", member.Revision, member.ChangeId)
+	}
+}
+
+func TestCheckGroupByRelationChainQuery(t *testing.T) {
+	versions := testCheck(t, Source{GroupBy: "relation_chain", Query: "status:open -change:2"},
+		Version{})
+	assert.Len(t, versions, 1)
+	assert.Equal(t, "testproject~testbranch~Itestchange1 deadbeef0,"+
+		"testproject~testbranch~Itestchange3 deadbeef0", versions[0].Members)
+}
+
+func TestCheckGroupWithoutNewVersions(t *testing.T) {
+	ver := testCheck(t, Source{GroupBy: "topic"}, Version{})[0]
+	versions := testCheck(t, Source{GroupBy: "topic"}, ver)
+	assert.Len(t, versions, 1)
+	assert.True(t, ver.Equal(versions[0]), "%v != %v", ver, versions[0])
+}
+
+func TestCheckGroupMemberLeft(t *testing.T) {
+	ver := testCheck(t, Source{GroupBy: "topic"}, Version{})[0]
+	members := ver.Members
+	// Change 5 was in the topic, but has been abandoned.
+	ver.Members += ",testproject~testbranch~Itestchange5 deadbeef0"
+
+	versions := testCheck(t, Source{GroupBy: "topic"}, ver)
+	if assert.Len(t, versions, 2) {
+		assert.True(t, ver.Equal(versions[0]), "%v != %v", ver, versions[0])
+		assert.Equal(t, members, versions[1].Members)
+		assert.True(t, versions[1].Created.After(ver.Created))
+	}
+}
+
+func TestCheckGroupMemberJoined(t *testing.T) {
+	ver := testCheck(t, Source{GroupBy: "topic"}, Version{})[0]
+	members := ver.Members
+	// Change 3 has joined the topic since.
+	ver.Members = "testproject~testbranch~Itestchange1 deadbeef0,testproject~testbranch~Itestchange2 deadbeef0"
+	ver.Created = time.Unix(200, 0)
+
+	versions := testCheck(t, Source{GroupBy: "topic"}, ver)
+	if assert.Len(t, versions, 2) {
+		assert.True(t, ver.Equal(versions[0]), "%v != %v", ver, versions[0])
+		assert.Equal(t, members, versions[1].Members)
+	}
+}
+
+func TestCheckSkipIfVoted(t *testing.T) {
+	ver := Version{
+		ChangeId: "Itestchange1",
+		Revision: "deadbeef0",
+		Created:  time.Unix(1, 0),
+	}
+	versions := testCheck(t, Source{SkipIfVoted: SkipIfVoted{
+		Label:   "Verified",
+		Account: "ci",
+	}}, ver)
+	assert.Len(t, versions, 6)
+	for _, v := range versions {
+		assert.False(t, v.ChangeId == "testproject~testbranch~Itestchange1" && v.Revision == "deadbeef2")
+		assert.False(t, v.ChangeId == "testproject~testbranch~Itestchange2" && v.Revision == "deadbeef0")
+		assert.False(t, v.ChangeId == "testproject~testbranch~Itestchange3" && v.Revision == "deadbeef0")
+	}
+	// The vote on the first revision of change 1 was removed.
+	assert.Contains(t, versions, Version{
+		ChangeId:     "testproject~testbranch~Itestchange1",
+		Revision:     "deadbeef0",
+		Created:      time.Unix(100, 0).UTC(),
+		ChangeNumber: 1,
+		PatchSet:     1,
+		Project:      "testproject",
+		Branch:       "testbranch",
+	})
+
+	versions = testCheck(t, Source{SkipIfVoted: SkipIfVoted{
+		Label:       "Verified",
+		Account:     "1000",
+		CopiedVotes: true,
+	}}, ver)
+	assert.Len(t, versions, 5)
+}
+
+func TestCheckSkipIfVotedOtherAccount(t *testing.T) {
+	versions := testCheck(t, Source{SkipIfVoted: SkipIfVoted{
+		Label:   "Verified",
+		Account: "someone-else",
+	}}, Version{
+		ChangeId: "Itestchange1",
+		Revision: "deadbeef0",
+		Created:  time.Unix(1, 0),
+	})
+	assert.Len(t, versions, 10)
+}
+
+func TestCheckRequireMergeable(t *testing.T) {
+	testGerritReviewedRevisions = nil
+	testGerritMergeableRequests = nil
+	versions := testCheck(t, Source{RequireMergeable: true}, Version{
+		ChangeId: "Itestchange1",
+		Revision: "deadbeef0",
+		Created:  time.Unix(1, 0),
+	})
+	// Only the current revision of change 2 is held back; mergeability of
+	// older revisions isn't known.
+	assert.Len(t, versions, 9)
+	for _, v := range versions {
+		if v.ChangeId == "testproject~testbranch~Itestchange2" {
+			assert.NotEqual(t, "deadbeef2", v.Revision)
+		}
+	}
+	assert.Empty(t, testGerritReviewedRevisions)
+	for _, req := range testGerritMergeableRequests {
+		assert.Contains(t, req, "deadbeef2")
+	}
+}
+
+func TestCheckMergeableInQuery(t *testing.T) {
+	testGerritMergeableInQuery = true
+	defer func() { testGerritMergeableInQuery = false }()
+	testGerritMergeableRequests = nil
+
+	versions := testCheck(t, Source{RequireMergeable: true}, Version{
+		ChangeId: "Itestchange1",
+		Revision: "deadbeef0",
+		Created:  time.Unix(2, 0),
+	})
+	assert.Len(t, versions, 9)
+	for _, v := range versions {
+		if v.ChangeId == "testproject~testbranch~Itestchange2" {
+			assert.NotEqual(t, "deadbeef2", v.Revision)
+		}
+	}
+	// The mergeable field from the query is enough.
+	assert.Empty(t, testGerritMergeableRequests)
+}
+
+func TestCheckMergeConflictMessage(t *testing.T) {
+	testGerritReviewedRevisions = nil
+	testCheck(t, Source{
+		RequireMergeable:     true,
+		MergeConflictMessage: "Please rebase",
+	}, Version{
+		ChangeId: "Itestchange1",
+		Revision: "deadbeef0",
+		Created:  time.Unix(1, 0),
+	})
+	// Only posted on the current revision
+	assert.Equal(t, []string{"testproject~testbranch~Itestchange2 deadbeef2"}, testGerritReviewedRevisions)
+	assert.Equal(t, "Please rebase", testGerritLastReviewInput.Message)
+}
+
+func TestHasMessage(t *testing.T) {
+	change := &changeInfo{ChangeInfo: testBuildChange(2, 3)}
+	assert.True(t, hasMessage(change, "deadbeef0", "Verified+1"))
+	assert.False(t, hasMessage(change, "deadbeef1", "Verified+1"))
+	assert.False(t, hasMessage(change, "deadbeef0", "Please rebase"))
+}
+
+func TestCheckExcludeFooters(t *testing.T) {
+	versions := testCheck(t, Source{ExcludeFooters: map[string]string{
+		"skip-ci": "true|yes",
+	}}, Version{
+		ChangeId: "Itestchange1",
+		Revision: "deadbeef0",
+		Created:  time.Unix(1, 0),
+	})
+	assert.Len(t, versions, 7)
+	for _, v := range versions {
+		assert.NotEqual(t, "testproject~testbranch~Itestchange3", v.ChangeId)
+	}
+}
+
+func TestCheckIncludeFooters(t *testing.T) {
+	versions := testCheck(t, Source{IncludeFooters: map[string]string{
+		"CI-Pipelines": "fast",
+	}}, Version{
+		ChangeId: "Itestchange1",
+		Revision: "deadbeef0",
+		Created:  time.Unix(1, 0),
+	})
+	// Change 2's revisions plus the requested version
+	assert.Len(t, versions, 4)
+}
+
+func TestCheckInvalidFooterPattern(t *testing.T) {
+	req := testRequest{
+		Source: Source{Url: testGerritUrl, ExcludeFooters: map[string]string{"Skip-CI": "("}},
+	}
+	assert.Error(t, resource.TestCheckFunc(t, req, nil, check))
+}
+
+func TestCheckConditionalRequests(t *testing.T) {
+	// The requested version isn't in query results, so it is fetched directly.
+	ver := Version{
+		ChangeId: "Itestchange2",
+		Revision: "deadbeef1",
+		Created:  time.Unix(60000, 0),
+	}
+	src := Source{Query: "conditional"}
+
+	testCheck(t, src, ver)
+	assert.Equal(t, "Itestchange2", testGerritLastChangeId)
+	assert.False(t, testGerritLastNotModified)
+
+	versions := testCheck(t, src, ver)
+	assert.True(t, testGerritLastNotModified)
+	assert.NotEmpty(t, versions)
+	lastVer := versions[len(versions)-1]
+	assert.True(t, ver.Equal(lastVer), "%v != %v", ver, lastVer)
+
+	// Changing the source uses a separate cache.
+	src.Query = "unconditional"
+	testCheck(t, src, ver)
+	assert.False(t, testGerritLastNotModified)
+}
+
+func TestResponseCacheSave(t *testing.T) {
+	src := Source{Query: "cache save"}
+	cache, err := loadResponseCache(src)
+	assert.NoError(t, err)
+	cache.put("key", &cachedResponse{ETag: `"etag"`, Body: []byte("body")})
+	assert.NoError(t, cache.save())
+
+	// The cache file is replaced without leaving temporary files behind.
+	matches, err := filepath.Glob(responseCacheFilename(src) + "*")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{responseCacheFilename(src)}, matches)
+
+	loaded, err := loadResponseCache(src)
+	assert.NoError(t, err)
+	assert.Equal(t, &cachedResponse{ETag: `"etag"`, Body: []byte("body")}, loaded.get("key"))
+}
+
+func TestVersionNumbersEncodedAsStrings(t *testing.T) {
+	data, err := json.Marshal(Version{ChangeNumber: 12345, PatchSet: 7})
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"change_number":"12345"`)
+	assert.Contains(t, string(data), `"patch_set":"7"`)
+
+	var ver Version
+	assert.NoError(t, json.Unmarshal(
+		[]byte(`{"change_id":"Itestchange1","revision":"deadbeef0"}`), &ver))
+	assert.Equal(t, 0, ver.ChangeNumber)
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	checkoutPatchSet = "patchset"
+	checkoutMerge    = "merge"
+	checkoutRebase   = "rebase"
+)
+
+var (
+	// checkoutIdentity is used for commits created by merge and rebase
+	// checkouts, which only exist locally.
+	checkoutIdentity = []string{
+		"GIT_AUTHOR_NAME=Concourse",
+		"GIT_AUTHOR_EMAIL=concourse@localhost",
+		"GIT_COMMITTER_NAME=Concourse",
+		"GIT_COMMITTER_EMAIL=concourse@localhost",
+	}
+)
+
+func validateCheckout(checkout string) error {
+	switch checkout {
+	case "", checkoutPatchSet, checkoutMerge, checkoutRebase:
+		return nil
+	default:
+		return fmt.Errorf("unsupported checkout %q", checkout)
+	}
+}
+
+// checkoutOntoBranch merges or rebases the checked out patch set onto the tip
+// of branch, returning the tip commit. With the default "patchset" checkout,
+// nothing is done.
+func checkoutOntoBranch(dir string, env []string, params inParams, branch string) (string, error) {
+	checkout := params.Checkout
+	if checkout == "" || checkout == checkoutPatchSet {
+		return "", nil
+	}
+
+	patchSet, err := gitOutput(dir, nil, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	fetchArgs := append([]string{"fetch"}, params.fetchArgs()...)
+	err = gitWithEnv(dir, env, append(fetchArgs, "origin", "refs/heads/"+branch)...)
+	if err != nil {
+		return "", fmt.Errorf("error fetching branch %q: %v", branch, err)
+	}
+	base, err := gitOutput(dir, nil, "rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	switch checkout {
+	case checkoutMerge:
+		// Merge the patch set into the branch, as submitting it would.
+		err = git(dir, "checkout", "--detach", base)
+		if err != nil {
+			return "", err
+		}
+		err = gitWithEnv(dir, checkoutIdentity, "merge", "--no-ff", "--no-edit",
+			"-m", fmt.Sprintf("Merge patch set into %s", branch), patchSet)
+	case checkoutRebase:
+		err = gitWithEnv(dir, checkoutIdentity, "rebase", base)
+	}
+	if err != nil {
+		conflicts, _ := gitOutput(dir, nil, "diff", "--name-only", "--diff-filter=U")
+		abortErr := git(dir, checkout, "--abort")
+		if abortErr != nil {
+			log.Printf("error aborting %s: %v", checkout, abortErr)
+		}
+		if conflicts != "" {
+			return "", fmt.Errorf("%s onto %s (%s) failed with conflicts in: %s",
+				checkout, branch, base, strings.Join(strings.Fields(conflicts), ", "))
+		}
+		return "", fmt.Errorf("%s onto %s (%s) failed: %v", checkout, branch, base, err)
+	}
+	return base, nil
+}
+
+// mergeRevisions merges the given revisions into the checked out tip, the last
+// revision, unless they're already ancestors of it. This is so that every
+// revision fetched for independent changes in the same project is built.
+func mergeRevisions(dir string, env []string, revisions []string) error {
+	if len(revisions) < 2 {
+		return nil
+	}
+	tip := revisions[len(revisions)-1]
+	independent, err := gitOutput(dir, nil,
+		append([]string{"merge-base", "--independent"}, revisions...)...)
+	if err != nil {
+		return err
+	}
+	for _, revision := range strings.Fields(independent) {
+		if revision == tip {
+			continue
+		}
+		err = gitWithEnv(dir, append(checkoutIdentity, env...), "merge", "--no-ff", "--no-edit",
+			"-m", fmt.Sprintf("Merge revision %s", revision), revision)
+		if err != nil {
+			conflicts, _ := gitOutput(dir, nil, "diff", "--name-only", "--diff-filter=U")
+			abortErr := git(dir, "merge", "--abort")
+			if abortErr != nil {
+				log.Printf("error aborting merge: %v", abortErr)
+			}
+			if conflicts != "" {
+				return fmt.Errorf("merging revision %s into %s failed with conflicts in: %s",
+					revision, tip, strings.Join(strings.Fields(conflicts), ", "))
+			}
+			return fmt.Errorf("merging revision %s into %s failed: %v", revision, tip, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/build/gerrit"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+const (
+	messagesFilename = "messages.json"
+	commentsFilename = "comments.json"
+)
+
+// changeMessage is a change message, as written to messages.json.
+type changeMessage struct {
+	Id       string              `json:"id"`
+	Author   *gerrit.AccountInfo `json:"author,omitempty"`
+	Date     time.Time           `json:"date"`
+	Message  string              `json:"message"`
+	PatchSet int                 `json:"patch_set,omitempty"`
+}
+
+// commentThread is an inline comment with its replies, as written to
+// comments.json. A thread is unresolved if its last comment is.
+type commentThread struct {
+	Path       string          `json:"path"`
+	PatchSet   int             `json:"patch_set"`
+	Line       int             `json:"line,omitempty"`
+	Range      *commentRange   `json:"range,omitempty"`
+	Unresolved bool            `json:"unresolved"`
+	Comments   []threadComment `json:"comments"`
+}
+
+type threadComment struct {
+	Id         string              `json:"id"`
+	Author     *gerrit.AccountInfo `json:"author,omitempty"`
+	Updated    time.Time           `json:"updated"`
+	Message    string              `json:"message"`
+	Unresolved bool                `json:"unresolved"`
+}
+
+// commentThreads groups comments into threads by following their replies,
+// ordered by path, patch set and line.
+func commentThreads(comments map[string][]commentInfo) []commentThread {
+	byId := make(map[string]commentInfo)
+	for _, pathComments := range comments {
+		for _, comment := range pathComments {
+			byId[comment.Id] = comment
+		}
+	}
+
+	threadRoot := func(comment commentInfo) commentInfo {
+		seen := map[string]bool{comment.Id: true}
+		for comment.InReplyTo != "" {
+			parent, ok := byId[comment.InReplyTo]
+			if !ok || seen[parent.Id] {
+				break
+			}
+			seen[parent.Id] = true
+			comment = parent
+		}
+		return comment
+	}
+
+	threads := make(map[string]*commentThread)
+	for _, comment := range byId {
+		root := threadRoot(comment)
+		thread, ok := threads[root.Id]
+		if !ok {
+			thread = &commentThread{
+				Path:     root.Path,
+				PatchSet: root.PatchSet,
+				Line:     root.Line,
+				Range:    root.Range,
+			}
+			threads[root.Id] = thread
+		}
+		thread.Comments = append(thread.Comments, threadComment{
+			Id:         comment.Id,
+			Author:     comment.Author,
+			Updated:    comment.Updated.Time(),
+			Message:    comment.Message,
+			Unresolved: comment.Unresolved,
+		})
+	}
+
+	sorted := []commentThread{}
+	for _, thread := range threads {
+		sort.Slice(thread.Comments, func(i, j int) bool {
+			return thread.Comments[i].Updated.Before(thread.Comments[j].Updated)
+		})
+		thread.Unresolved = thread.Comments[len(thread.Comments)-1].Unresolved
+		sorted = append(sorted, *thread)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.PatchSet != b.PatchSet {
+			return a.PatchSet < b.PatchSet
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Comments[0].Updated.Before(b.Comments[0].Updated)
+	})
+	return sorted
+}
+
+// inComments writes the messages of a change to messages.json and its
+// published inline comment threads to comments.json in the resource directory
+// of dir, adding the number of unresolved threads to the response metadata.
+func inComments(
+	req resource.InRequest,
+	c gerritService,
+	ctx context.Context,
+	dir string,
+	change *changeInfo,
+) error {
+	messages := []changeMessage{}
+	for _, info := range change.Messages {
+		messages = append(messages, changeMessage{
+			Id:       info.ID,
+			Author:   info.Author,
+			Date:     info.Time.Time(),
+			Message:  info.Message,
+			PatchSet: info.RevisionNumber,
+		})
+	}
+	messagesPath, err := resourceFilePath(dir, messagesFilename)
+	if err == nil {
+		err = writeMessages(messagesPath, messages)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", messagesFilename, err)
+	}
+
+	comments, err := c.getComments(ctx, change.ID)
+	if err == errUnsupportedOverSsh {
+		log.Printf("not writing %s: %v", commentsFilename, err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting comments: %v", err)
+	}
+
+	threads := commentThreads(comments)
+	unresolved := 0
+	for _, thread := range threads {
+		if thread.Unresolved {
+			unresolved++
+		}
+	}
+	req.AddResponseMetadata("unresolved comment threads", strconv.Itoa(unresolved))
+
+	commentsPath, err := resourceFilePath(dir, commentsFilename)
+	if err == nil {
+		err = writeCommentThreads(commentsPath, threads)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", commentsFilename, err)
+	}
+	return nil
+}
+
+func writeMessages(path string, messages []changeMessage) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(messages)
+}
+
+func writeCommentThreads(path string, threads []commentThread) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(threads)
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/build/gerrit"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+const (
+	dependsOnFooter   = "Depends-On"
+	dependsOnDir      = "depends-on"
+	dependsOnFilename = "depends_on.json"
+)
+
+// dependency is a change named in a Depends-On footer, as written to
+// depends_on.json.
+type dependency struct {
+	Version
+	Status string `json:"status"`
+	// Path is the directory the dependency was fetched into, relative to the
+	// target directory. It is empty if downloads are skipped.
+	Path string `json:"path,omitempty"`
+}
+
+// dependsOnChangeId returns the change ID for a Depends-On footer value, which
+// is either a change ID or a change URL like
+// "https://review.example.com/c/project/+/12345".
+func dependsOnChangeId(value string) (string, error) {
+	if !strings.Contains(value, "/") {
+		return value, nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	// Old style URLs have the path in the fragment, e.g. "/#/c/12345/".
+	parts := strings.Split(strings.Trim(u.Path+"/"+u.Fragment, "/"), "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if _, err := strconv.Atoi(parts[i]); err == nil && i > 0 &&
+			(parts[i-1] == "+" || parts[i-1] == "c") {
+			return parts[i], nil
+		}
+	}
+	return "", fmt.Errorf("no change number in %q", value)
+}
+
+// inDependencies fetches the current revisions of changes named in Depends-On
+// footers into a subdirectory per project under depends-on/ in dir, merging
+// dependencies in the same project, and writes depends_on.json to the resource
+// directory of dir. It fails if any dependency is abandoned.
+func inDependencies(
+	req resource.InRequest,
+	c gerritService,
+	ctx context.Context,
+	dir string,
+	footers Footers,
+	params inParams,
+	authMan *authManager,
+) error {
+	values := footers.Get(dependsOnFooter)
+	if len(values) == 0 {
+		return nil
+	}
+
+	// fetch_url refers to the repository of the requested change only.
+	params.FetchUrl = ""
+
+	var projects []string
+	projectRevs := make(map[string]map[string]*gerrit.RevisionInfo)
+	projectBranches := make(map[string]string)
+	deps := []dependency{}
+	for _, value := range values {
+		changeId, err := dependsOnChangeId(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", dependsOnFooter, value, err)
+		}
+		change, err := c.getChange(ctx, changeId, "CURRENT_REVISION", "CURRENT_COMMIT")
+		if err != nil {
+			return fmt.Errorf("error getting dependency %q: %v", value, err)
+		}
+		if change.Status == "ABANDONED" {
+			return fmt.Errorf("dependency %q (change %d) is abandoned", value, change.ChangeNumber)
+		}
+		rev, ok := change.Revisions[change.CurrentRevision]
+		if !ok {
+			return fmt.Errorf("no current revision for dependency %q", value)
+		}
+
+		if projectRevs[change.Project] == nil {
+			projects = append(projects, change.Project)
+			projectRevs[change.Project] = make(map[string]*gerrit.RevisionInfo)
+			projectBranches[change.Project] = change.Branch
+		}
+		projectRevs[change.Project][change.CurrentRevision] = &rev
+
+		dep := dependency{
+			Version: newVersion(change, change.CurrentRevision),
+			Status:  change.Status,
+		}
+		if !params.SkipDownload {
+			dep.Path = filepath.Join(dependsOnDir, change.Project)
+		}
+		deps = append(deps, dep)
+		req.AddResponseMetadata("depends on", fmt.Sprintf("%d/%d %s %s",
+			change.ChangeNumber, rev.PatchSetNumber, change.Project, change.Subject))
+	}
+
+	if !params.SkipDownload {
+		excludeFromGit(dir, dependsOnDir)
+		for _, project := range projects {
+			projectDir := filepath.Join(dir, dependsOnDir, project)
+			err := os.MkdirAll(projectDir, 0755)
+			if err != nil {
+				return err
+			}
+			_, err = fetchRevisions(projectDir, authMan, params,
+				projectBranches[project], projectRevs[project])
+			if err != nil {
+				return fmt.Errorf("error fetching dependencies in project %q: %v", project, err)
+			}
+		}
+	}
+
+	depsPath, err := resourceFilePath(dir, dependsOnFilename)
+	if err == nil {
+		err = writeDependencies(depsPath, deps)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", dependsOnFilename, err)
+	}
+	return nil
+}
+
+func writeDependencies(path string, deps []dependency) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(deps)
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+
+	"golang.org/x/build/gerrit"
+)
+
+const (
+	gerritEnvFilename = "gerrit.env"
+)
+
+// changeBranchName returns the name of the local branch checked out for a
+// patch set.
+func changeBranchName(changeNumber int, patchSet int) string {
+	return fmt.Sprintf("change/%d/%d", changeNumber, patchSet)
+}
+
+// checkoutChangeBranch checks out a local branch for a patch set at HEAD in
+// the git repo in dir, tracking the change's target branch.
+func checkoutChangeBranch(dir string, changeNumber int, patchSet int, branch string) error {
+	name := changeBranchName(changeNumber, patchSet)
+	err := git(dir, "checkout", "-B", name)
+	if err != nil {
+		return err
+	}
+	// The target branch may not have been fetched, so the upstream is
+	// configured directly rather than with --set-upstream-to.
+	err = git(dir, "config", fmt.Sprintf("branch.%s.remote", name), "origin")
+	if err != nil {
+		return err
+	}
+	return git(dir, "config", fmt.Sprintf("branch.%s.merge", name), "refs/heads/"+branch)
+}
+
+// gerritEnv returns the variables the Gerrit Trigger Jenkins plugin sets for a
+// change revision, in order.
+// See: https://plugins.jenkins.io/gerrit-trigger/
+func gerritEnv(src Source, change *changeInfo, revision string, rev *gerrit.RevisionInfo) [][2]string {
+	env := [][2]string{
+		{"GERRIT_PROJECT", change.Project},
+		{"GERRIT_BRANCH", change.Branch},
+		{"GERRIT_TOPIC", change.Topic},
+		{"GERRIT_CHANGE_NUMBER", strconv.Itoa(change.ChangeNumber)},
+		{"GERRIT_CHANGE_ID", change.ChangeID},
+		{"GERRIT_CHANGE_SUBJECT", change.Subject},
+		{"GERRIT_PATCHSET_NUMBER", strconv.Itoa(rev.PatchSetNumber)},
+		{"GERRIT_PATCHSET_REVISION", revision},
+		{"GERRIT_REFSPEC", rev.Ref},
+	}
+
+	link, err := buildChangeLink(src, change.ChangeNumber)
+	if err == nil {
+		env = append(env, [2]string{"GERRIT_CHANGE_URL", link})
+	} else {
+		log.Printf("error building change link: %v", err)
+	}
+
+	if change.Owner != nil {
+		env = append(env,
+			[2]string{"GERRIT_CHANGE_OWNER", fmt.Sprintf("%s <%s>", change.Owner.Name, change.Owner.Email)},
+			[2]string{"GERRIT_CHANGE_OWNER_NAME", change.Owner.Name},
+			[2]string{"GERRIT_CHANGE_OWNER_EMAIL", change.Owner.Email})
+	}
+	if rev.Uploader != nil {
+		env = append(env,
+			[2]string{"GERRIT_PATCHSET_UPLOADER", fmt.Sprintf("%s <%s>", rev.Uploader.Name, rev.Uploader.Email)},
+			[2]string{"GERRIT_PATCHSET_UPLOADER_NAME", rev.Uploader.Name},
+			[2]string{"GERRIT_PATCHSET_UPLOADER_EMAIL", rev.Uploader.Email})
+	}
+	if rev.Commit != nil {
+		// The plugin base64 encodes the commit message.
+		env = append(env, [2]string{"GERRIT_CHANGE_COMMIT_MESSAGE",
+			base64.StdEncoding.EncodeToString([]byte(rev.Commit.Message))})
+	}
+	return env
+}
+
+// writeGerritEnv writes env to path as shell variable assignments, to be
+// sourced by tasks.
+func writeGerritEnv(path string, env [][2]string) error {
+	var buf bytes.Buffer
+	for _, kv := range env {
+		fmt.Fprintf(&buf, "%s=%s\n", kv[0], shellQuote(kv[1]))
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
@@ -0,0 +1,251 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	"golang.org/x/build/gerrit"
+)
+
+// checkExtraFields returns the fields needed to filter revisions.
+func checkExtraFields(src Source) []string {
+	var fields []string
+	addField := func(field string) {
+		for _, f := range fields {
+			if f == field {
+				return
+			}
+		}
+		fields = append(fields, field)
+	}
+	if src.SkipIfVoted.Label != "" {
+		addField("DETAILED_LABELS")
+		addField("DETAILED_ACCOUNTS")
+	}
+	if src.MergeConflictMessage != "" {
+		addField("MESSAGES")
+	}
+	if len(src.IncludeFooters) > 0 || len(src.ExcludeFooters) > 0 {
+		addField("ALL_COMMITS")
+	}
+	return fields
+}
+
+// skipRevision reports whether a revision should be left out of check results.
+func skipRevision(
+	c gerritService,
+	ctx context.Context,
+	src Source,
+	change *changeInfo,
+	revision string,
+) bool {
+	if src.SkipIfVoted.Label != "" && src.SkipIfVoted.voted(c, ctx, change, revision) {
+		log.Printf("skipping revision %q of change %q: already voted", revision, change.ID)
+		return true
+	}
+	if src.RequireMergeable && !mergeable(c, ctx, src, change, revision) {
+		log.Printf("skipping revision %q of change %q: not mergeable", revision, change.ID)
+		return true
+	}
+	if !footersIncluded(src, change, revision) {
+		log.Printf("skipping revision %q of change %q: excluded by footers", revision, change.ID)
+		return true
+	}
+	return false
+}
+
+// skipGroup reports whether a grouped version should be left out of check
+// results. changes maps the group's member change IDs to their changes.
+func skipGroup(
+	c gerritService,
+	ctx context.Context,
+	src Source,
+	ver Version,
+	changes map[string]*changeInfo,
+) bool {
+	members, err := ver.groupMembers()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	// Skip groups where every member has been voted on.
+	if src.SkipIfVoted.Label != "" {
+		allVoted := true
+		for _, member := range members {
+			change, ok := changes[member.ChangeId]
+			if !ok || !src.SkipIfVoted.voted(c, ctx, change, member.Revision) {
+				allVoted = false
+				break
+			}
+		}
+		if allVoted {
+			log.Printf("skipping group %q: already voted", ver.Group)
+			return true
+		}
+	}
+
+	// Skip groups where every member is excluded by footers.
+	if len(src.IncludeFooters) > 0 || len(src.ExcludeFooters) > 0 {
+		allExcluded := true
+		for _, member := range members {
+			change, ok := changes[member.ChangeId]
+			if !ok || footersIncluded(src, change, member.Revision) {
+				allExcluded = false
+				break
+			}
+		}
+		if allExcluded {
+			log.Printf("skipping group %q: excluded by footers", ver.Group)
+			return true
+		}
+	}
+
+	// Hold back groups until every member is mergeable.
+	if src.RequireMergeable {
+		for _, member := range members {
+			change, ok := changes[member.ChangeId]
+			if ok && !mergeable(c, ctx, src, change, member.Revision) {
+				log.Printf("skipping group %q: %q not mergeable", ver.Group, member.ChangeId)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// voted reports whether the account has a non-zero vote on the label on the
+// given revision. Votes on the current revision are in the change's labels;
+// votes on earlier revisions are requested. Errors are logged and treated as
+// not voted.
+func (s SkipIfVoted) voted(
+	c gerritService,
+	ctx context.Context,
+	change *changeInfo,
+	revision string,
+) bool {
+	rev, ok := change.Revisions[revision]
+	if !ok {
+		return false
+	}
+
+	labels := change.Labels
+	if revision != change.CurrentRevision {
+		var err error
+		labels, err = c.getRevisionLabels(ctx, change.ID, revision)
+		if err != nil {
+			log.Printf("error getting votes on revision %q: %v", revision, err)
+			return false
+		}
+	}
+	// A vote from before the revision was created was copied from an earlier
+	// patch set.
+	for _, approval := range labels[s.Label].All {
+		if approval.Value != 0 && s.isAccount(&approval.AccountInfo) &&
+			(s.CopiedVotes || !approval.Date.Time().Before(rev.Created.Time())) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s SkipIfVoted) isAccount(account *gerrit.AccountInfo) bool {
+	if account == nil {
+		return false
+	}
+	return s.Account == account.Username ||
+		s.Account == account.Email ||
+		s.Account == strconv.FormatInt(account.NumericID, 10)
+}
+
+// footersIncluded reports whether a revision's commit message footers match
+// every src.IncludeFooters rule and no src.ExcludeFooters rule.
+func footersIncluded(src Source, change *changeInfo, revision string) bool {
+	rev, ok := change.Revisions[revision]
+	if !ok || rev.Commit == nil {
+		return true
+	}
+	footers := parseFooters(rev.Commit.Message)
+	for key, pattern := range src.IncludeFooters {
+		if match, _ := footers.matches(key, pattern); !match {
+			return false
+		}
+	}
+	for key, pattern := range src.ExcludeFooters {
+		if match, _ := footers.matches(key, pattern); match {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeable reports whether a revision can be merged into its target branch.
+// Gerrit only computes mergeability for the current revision of a change, so
+// other revisions are always treated as mergeable. The mergeable field of the
+// change is used if the server set it; otherwise the server is asked. Errors
+// are logged and treated as mergeable. If src.MergeConflictMessage is set, it
+// is posted once on unmergeable revisions.
+func mergeable(
+	c gerritService,
+	ctx context.Context,
+	src Source,
+	change *changeInfo,
+	revision string,
+) bool {
+	if revision != change.CurrentRevision {
+		return true
+	}
+	var mergeable bool
+	if change.Mergeable != nil {
+		mergeable = *change.Mergeable
+	} else {
+		var err error
+		mergeable, err = c.getMergeable(ctx, change.ID, revision)
+		if err != nil {
+			log.Printf("error checking if revision %q is mergeable: %v", revision, err)
+			return true
+		}
+	}
+	if !mergeable && src.MergeConflictMessage != "" &&
+		!hasMessage(change, revision, src.MergeConflictMessage) {
+		err := c.setReview(ctx, change.ID, revision, reviewInput{
+			Message: src.MergeConflictMessage,
+		})
+		if err != nil {
+			log.Printf("error posting merge conflict message: %v", err)
+		}
+	}
+	return mergeable
+}
+
+// hasMessage reports whether a change message containing the given message was
+// already posted on the revision.
+func hasMessage(change *changeInfo, revision string, message string) bool {
+	rev, ok := change.Revisions[revision]
+	if !ok {
+		return false
+	}
+	for _, changeMessage := range change.Messages {
+		if changeMessage.RevisionNumber == rev.PatchSetNumber &&
+			strings.Contains(changeMessage.Message, message) {
+			return true
+		}
+	}
+	return false
+}
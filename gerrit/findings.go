@@ -0,0 +1,489 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	severityInfo    = "info"
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+var (
+	severityRanks = map[string]int{
+		severityInfo:    1,
+		severityWarning: 2,
+		severityError:   3,
+	}
+
+	// compilerPattern matches diagnostics like "file:line:col: message" and
+	// "file:line: warning: message".
+	compilerPattern = regexp.MustCompile(
+		`^([^\s:][^:]*):(\d+):(?:(\d+):)?\s*(?:(error|warning|note|info)\s*:\s*)?(.+)$`)
+)
+
+// finding is a problem reported by a tool, e.g. a linter or test runner.
+type finding struct {
+	Path     string
+	Line     int
+	Severity string
+	Rule     string
+	Message  string
+}
+
+func (f finding) commentMessage() string {
+	if f.Rule != "" {
+		return fmt.Sprintf("%s: %s", f.Rule, f.Message)
+	}
+	return f.Message
+}
+
+func (f finding) comment() fileComment {
+	return fileComment{
+		Path:       f.Path,
+		Line:       f.Line,
+		Message:    f.commentMessage(),
+		Unresolved: f.Severity != severityInfo,
+	}
+}
+
+// validateSeverity returns an error if severity isn't a known severity.
+func validateSeverity(severity string) error {
+	if _, ok := severityRanks[severity]; !ok {
+		return fmt.Errorf("unsupported severity %q", severity)
+	}
+	return nil
+}
+
+// readFindings reads findings from a file in SARIF, Checkstyle XML or JUnit
+// XML format, or compiler style output, detected from its contents.
+func readFindings(path string) ([]finding, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		return parseSarif(trimmed)
+	}
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		root, err := xmlRootName(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		switch root {
+		case "checkstyle":
+			return parseCheckstyle(trimmed)
+		case "testsuites", "testsuite":
+			return parseJunit(trimmed)
+		default:
+			return nil, fmt.Errorf("unsupported XML format <%s>", root)
+		}
+	}
+	return parseCompilerOutput(data), nil
+}
+
+func xmlRootName(data []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
+
+// See: https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+type sarifLog struct {
+	Runs []struct {
+		Tool struct {
+			Driver struct {
+				Rules []struct {
+					Id                   string `json:"id"`
+					DefaultConfiguration struct {
+						Level string `json:"level"`
+					} `json:"defaultConfiguration"`
+				} `json:"rules"`
+			} `json:"driver"`
+		} `json:"tool"`
+		Results []struct {
+			RuleId  string `json:"ruleId"`
+			Kind    string `json:"kind"`
+			Level   string `json:"level"`
+			Message struct {
+				Text string `json:"text"`
+			} `json:"message"`
+			Locations []struct {
+				PhysicalLocation struct {
+					ArtifactLocation struct {
+						Uri string `json:"uri"`
+					} `json:"artifactLocation"`
+					Region struct {
+						StartLine int `json:"startLine"`
+					} `json:"region"`
+				} `json:"physicalLocation"`
+			} `json:"locations"`
+		} `json:"results"`
+	} `json:"runs"`
+}
+
+func parseSarif(data []byte) ([]finding, error) {
+	var sarif sarifLog
+	err := json.Unmarshal(data, &sarif)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SARIF: %v", err)
+	}
+
+	var findings []finding
+	for _, run := range sarif.Runs {
+		ruleLevels := make(map[string]string)
+		for _, rule := range run.Tool.Driver.Rules {
+			ruleLevels[rule.Id] = rule.DefaultConfiguration.Level
+		}
+		for _, result := range run.Results {
+			if result.Kind != "" && result.Kind != "fail" {
+				continue
+			}
+			level := result.Level
+			if level == "" {
+				level = ruleLevels[result.RuleId]
+			}
+			var severity string
+			switch level {
+			case "error":
+				severity = severityError
+			case "warning", "":
+				severity = severityWarning
+			case "note":
+				severity = severityInfo
+			default:
+				continue
+			}
+
+			f := finding{
+				Severity: severity,
+				Rule:     result.RuleId,
+				Message:  result.Message.Text,
+			}
+			if len(result.Locations) > 0 {
+				location := result.Locations[0].PhysicalLocation
+				f.Path = sarifUriPath(location.ArtifactLocation.Uri)
+				f.Line = location.Region.StartLine
+			}
+			findings = append(findings, f)
+		}
+	}
+	return findings, nil
+}
+
+// sarifUriPath returns the path of a relative or file URI.
+func sarifUriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return u.Path
+}
+
+// See: https://checkstyle.org/
+type checkstyleReport struct {
+	Files []struct {
+		Name   string `xml:"name,attr"`
+		Errors []struct {
+			Line     int    `xml:"line,attr"`
+			Severity string `xml:"severity,attr"`
+			Message  string `xml:"message,attr"`
+			Source   string `xml:"source,attr"`
+		} `xml:"error"`
+	} `xml:"file"`
+}
+
+func parseCheckstyle(data []byte) ([]finding, error) {
+	var report checkstyleReport
+	err := xml.Unmarshal(data, &report)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Checkstyle XML: %v", err)
+	}
+
+	var findings []finding
+	for _, file := range report.Files {
+		for _, e := range file.Errors {
+			severity := e.Severity
+			switch severity {
+			case severityError, severityWarning, severityInfo:
+			case "ignore":
+				continue
+			default:
+				severity = severityError
+			}
+			findings = append(findings, finding{
+				Path:     file.Name,
+				Line:     e.Line,
+				Severity: severity,
+				Rule:     e.Source,
+				Message:  e.Message,
+			})
+		}
+	}
+	return findings, nil
+}
+
+// junitSuite is a JUnit XML test suite, or a list of them.
+type junitSuite struct {
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []struct {
+		ClassName string        `xml:"classname,attr"`
+		Name      string        `xml:"name,attr"`
+		File      string        `xml:"file,attr"`
+		Line      int           `xml:"line,attr"`
+		Failures  []junitResult `xml:"failure"`
+		Errors    []junitResult `xml:"error"`
+	} `xml:"testcase"`
+}
+
+type junitResult struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func parseJunit(data []byte) ([]finding, error) {
+	var suite junitSuite
+	err := xml.Unmarshal(data, &suite)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JUnit XML: %v", err)
+	}
+	return junitFindings(suite), nil
+}
+
+func junitFindings(suite junitSuite) []finding {
+	var findings []finding
+	for _, testCase := range suite.Cases {
+		name := testCase.Name
+		if testCase.ClassName != "" {
+			name = testCase.ClassName + "." + name
+		}
+		for _, result := range append(testCase.Failures, testCase.Errors...) {
+			message := result.Message
+			if message == "" {
+				message = strings.TrimSpace(result.Text)
+			}
+			findings = append(findings, finding{
+				Path:     testCase.File,
+				Line:     testCase.Line,
+				Severity: severityError,
+				Message:  strings.TrimSpace(fmt.Sprintf("%s failed: %s", name, message)),
+			})
+		}
+	}
+	for _, child := range suite.Suites {
+		findings = append(findings, junitFindings(child)...)
+	}
+	return findings
+}
+
+// parseCompilerOutput parses diagnostics like "file:line:col: message",
+// ignoring other lines. Diagnostics without a severity are errors.
+func parseCompilerOutput(data []byte) []finding {
+	var findings []finding
+	for _, line := range strings.Split(string(data), "\n") {
+		match := compilerPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		lineNumber, _ := strconv.Atoi(match[2])
+		severity := match[4]
+		switch severity {
+		case "":
+			severity = severityError
+		case "note":
+			severity = severityInfo
+		}
+		findings = append(findings, finding{
+			Path:     match[1],
+			Line:     lineNumber,
+			Severity: severity,
+			Message:  match[5],
+		})
+	}
+	return findings
+}
+
+// outFindings reads the findings files matching params.Findings in dir,
+// returning those to post as comments on vers and summary lines for the review
+// message. Findings below params.FindingsSeverity and findings the current
+// account already posted on the same patch set are left out, and at most
+// params.MaxComments are posted.
+func outFindings(
+	c gerritService,
+	ctx context.Context,
+	dir string,
+	vers []Version,
+	params outParams,
+) ([]fileComment, []string, error) {
+	var findings []finding
+	for _, pattern := range params.Findings {
+		paths, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(paths) == 0 {
+			return nil, nil, fmt.Errorf("no findings files match %q", pattern)
+		}
+		for _, path := range paths {
+			pathFindings, err := readFindings(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("error reading findings %q: %v", path, err)
+			}
+			findings = append(findings, pathFindings...)
+		}
+	}
+
+	minSeverity := params.FindingsSeverity
+	if minSeverity == "" {
+		minSeverity = severityInfo
+	}
+	var kept []finding
+	for _, f := range findings {
+		if strings.TrimSpace(f.Message) != "" &&
+			severityRanks[f.Severity] >= severityRanks[minSeverity] {
+			kept = append(kept, f)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, nil, nil
+	}
+
+	posted, err := postedComments(c, ctx, vers)
+	if err == errUnsupportedOverSsh || err == errAnonymous {
+		log.Printf("not checking for posted findings: %v", err)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("error getting posted comments: %v", err)
+	}
+	findings = kept
+	kept = nil
+	for _, f := range findings {
+		if !isPosted(f, posted) {
+			kept = append(kept, f)
+		}
+	}
+
+	// Post the most severe findings first.
+	sort.SliceStable(kept, func(i, j int) bool {
+		a, b := kept[i], kept[j]
+		if a.Severity != b.Severity {
+			return severityRanks[a.Severity] > severityRanks[b.Severity]
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Line < b.Line
+	})
+	var dropped int
+	if params.MaxComments > 0 && len(kept) > params.MaxComments {
+		dropped = len(kept) - params.MaxComments
+		kept = kept[:params.MaxComments]
+	}
+
+	var comments []fileComment
+	var summary []string
+	for _, f := range kept {
+		if f.Path == "" {
+			summary = append(summary, f.commentMessage())
+		} else {
+			comments = append(comments, f.comment())
+		}
+	}
+	if dropped > 0 {
+		summary = append(summary, fmt.Sprintf("%d more findings weren't posted.", dropped))
+	}
+	return comments, summary, nil
+}
+
+// postedComments returns the comments and robot comments the current account
+// has posted on the patch sets of vers. Comments on other patch sets don't
+// count, so findings still present in a new patch set are posted again.
+func postedComments(c gerritService, ctx context.Context, vers []Version) ([]commentInfo, error) {
+	self, err := c.getSelf(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var posted []commentInfo
+	for _, ver := range vers {
+		patchSet := ver.PatchSet
+		if patchSet == 0 {
+			// Older versions don't record their patch set.
+			_, rev, err := getVersionChangeRevision(c, ctx, ver)
+			if err != nil {
+				return nil, err
+			}
+			patchSet = rev.PatchSetNumber
+		}
+		// Findings are posted as robot comments with robot_id.
+		for _, getComments := range []func(context.Context, string) (map[string][]commentInfo, error){
+			c.getComments,
+			c.getRobotComments,
+		} {
+			comments, err := getComments(ctx, ver.ChangeId)
+			if err != nil {
+				return nil, err
+			}
+			for _, pathComments := range comments {
+				for _, comment := range pathComments {
+					if comment.PatchSet == patchSet && comment.Author != nil &&
+						comment.Author.NumericID == self.NumericID {
+						posted = append(posted, comment)
+					}
+				}
+			}
+		}
+	}
+	return posted, nil
+}
+
+// isPosted reports whether a finding has already been posted as one of the
+// given comments.
+func isPosted(f finding, posted []commentInfo) bool {
+	for _, comment := range posted {
+		if comment.Line == f.Line && comment.Message == f.commentMessage() &&
+			matchesFilePath(f.Path, comment.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesFilePath reports whether path, which may be absolute or relative to
+// another directory, refers to the file at filePath in the repository.
+func matchesFilePath(path string, filePath string) bool {
+	return path == filePath || strings.HasSuffix(path, "/"+filePath)
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testSarif = `{
+		"version": "2.1.0",
+		"runs": [{
+			"tool": {"driver": {"name": "lint", "rules": [
+				{"id": "L1", "defaultConfiguration": {"level": "error"}}
+			]}},
+			"results": [
+				{"ruleId": "L1", "message": {"text": "Unused variable"},
+				 "locations": [{"physicalLocation": {
+					"artifactLocation": {"uri": "file:///src/repo/main.go"},
+					"region": {"startLine": 4}}}]},
+				{"ruleId": "L2", "level": "note", "message": {"text": "Consider renaming"},
+				 "locations": [{"physicalLocation": {
+					"artifactLocation": {"uri": "new.go"},
+					"region": {"startLine": 1}}}]},
+				{"ruleId": "L3", "kind": "pass", "message": {"text": "Passed"}},
+				{"ruleId": "L4", "level": "none", "message": {"text": "Ignored"}},
+				{"ruleId": "L5", "message": {"text": "No tests"}}
+			]
+		}]
+	}`
+
+	testCheckstyle = `<?xml version="1.0" encoding="UTF-8"?>
+		<checkstyle version="8.0">
+			<file name="/src/repo/main.go">
+				<error line="3" severity="warning" message="Line too long" source="lll"/>
+				<error line="5" severity="ignore" message="Ignored" source="lll"/>
+			</file>
+		</checkstyle>`
+
+	testJunit = `<?xml version="1.0" encoding="UTF-8"?>
+		<testsuites>
+			<testsuite name="main">
+				<testcase classname="main" name="TestOk" file="main_test.go" line="1"/>
+				<testcase classname="main" name="TestMain" file="main.go" line="12">
+					<failure message="expected 1, got 2">details</failure>
+				</testcase>
+			</testsuite>
+		</testsuites>`
+
+	testCompilerOutput = `# example.com/repo
+./main.go:7:2: undefined: foo
+new.go:2: warning: unused import
+main.go:9:1: note: declared here
+ok  	example.com/repo	0.1s
+`
+)
+
+func testWriteFindings(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir(testTempDir, "findings")
+	assert.NoError(t, err)
+	for name, contents := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600)
+		assert.NoError(t, err)
+	}
+	return dir
+}
+
+func TestReadFindings(t *testing.T) {
+	dir := testWriteFindings(t, map[string]string{
+		"lint.sarif":      testSarif,
+		"checkstyle.xml":  testCheckstyle,
+		"junit.xml":       testJunit,
+		"build.log":       testCompilerOutput,
+		"unsupported.xml": "<html></html>",
+		"invalid.sarif":   "{",
+	})
+	for _, tc := range []struct {
+		name     string
+		findings []finding
+	}{
+		{"lint.sarif", []finding{
+			{Path: "/src/repo/main.go", Line: 4, Severity: "error", Rule: "L1", Message: "Unused variable"},
+			{Path: "new.go", Line: 1, Severity: "info", Rule: "L2", Message: "Consider renaming"},
+			{Severity: "warning", Rule: "L5", Message: "No tests"},
+		}},
+		{"checkstyle.xml", []finding{
+			{Path: "/src/repo/main.go", Line: 3, Severity: "warning", Rule: "lll", Message: "Line too long"},
+		}},
+		{"junit.xml", []finding{
+			{Path: "main.go", Line: 12, Severity: "error", Message: "main.TestMain failed: expected 1, got 2"},
+		}},
+		{"build.log", []finding{
+			{Path: "./main.go", Line: 7, Severity: "error", Message: "undefined: foo"},
+			{Path: "new.go", Line: 2, Severity: "warning", Message: "unused import"},
+			{Path: "main.go", Line: 9, Severity: "info", Message: "declared here"},
+		}},
+	} {
+		findings, err := readFindings(filepath.Join(dir, tc.name))
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.findings, findings, tc.name)
+	}
+
+	for _, name := range []string{"unsupported.xml", "invalid.sarif"} {
+		_, err := readFindings(filepath.Join(dir, name))
+		assert.Error(t, err, name)
+	}
+}
+
+func testOutFindings(t *testing.T, files map[string]string, params outParams) error {
+	return testOutFindingsWithVersion(t,
+		Version{ChangeId: "Itestchange1", Revision: "deadbeef0"}, files, params)
+}
+
+func testOutFindingsWithVersion(
+	t *testing.T, ver Version, files map[string]string, params outParams,
+) error {
+	dir := testWriteFindings(t, files)
+	for i, pattern := range params.Findings {
+		params.Findings[i] = filepath.Join(filepath.Base(dir), pattern)
+	}
+	return testOutCommentsWithVersion(t, Source{Username: "ci", Password: "pass"}, ver, `[]`, params)
+}
+
+func TestOutFindings(t *testing.T) {
+	err := testOutFindings(t, map[string]string{
+		"lint.sarif":     testSarif,
+		"checkstyle.xml": testCheckstyle,
+		"build.log":      testCompilerOutput,
+	}, outParams{Message: "Lint", Findings: []string{"*.sarif", "*.xml", "build.log"}})
+	assert.NoError(t, err)
+
+	review := testGerritLastReviewInput
+	assert.Equal(t, "Lint\n\nL5: No tests", review.Message)
+	assert.Equal(t, map[string][]commentInput{
+		"main.go": {
+			{Line: 7, Message: "undefined: foo", Unresolved: true},
+			{Line: 4, Message: "L1: Unused variable", Unresolved: true},
+			{Line: 3, Message: "lll: Line too long", Unresolved: true},
+			{Line: 9, Message: "declared here"},
+		},
+		"new.go": {
+			{Line: 2, Message: "unused import", Unresolved: true},
+			{Line: 1, Message: "L2: Consider renaming"},
+		},
+	}, review.Comments)
+}
+
+func TestOutFindingsSeverity(t *testing.T) {
+	err := testOutFindings(t, map[string]string{"build.log": testCompilerOutput},
+		outParams{Findings: []string{"build.log"}, FindingsSeverity: "warning", MaxComments: 1})
+	assert.NoError(t, err)
+
+	review := testGerritLastReviewInput
+	assert.Equal(t, "1 more findings weren't posted.", review.Message)
+	assert.Equal(t, map[string][]commentInput{
+		"main.go": {{Line: 7, Message: "undefined: foo", Unresolved: true}},
+	}, review.Comments)
+}
+
+func TestOutFindingsPosted(t *testing.T) {
+	// The CI account already posted c3 on patch set 2.
+	for _, tc := range []struct {
+		revision string
+		comments map[string][]commentInput
+	}{
+		{"deadbeef1", map[string][]commentInput{
+			"main.go": {{Line: 3, Message: "Typo", Unresolved: true}},
+		}},
+		{"deadbeef0", map[string][]commentInput{
+			"main.go": {
+				{Line: 3, Message: "Typo", Unresolved: true},
+				{Line: 10, Message: "Why?", Unresolved: true},
+			},
+		}},
+	} {
+		err := testOutFindingsWithVersion(t,
+			Version{ChangeId: "Itestchange1", Revision: tc.revision},
+			map[string]string{"build.log": "main.go:10: Why?\nmain.go:3: Typo\n"},
+			outParams{Findings: []string{"build.log"}})
+		assert.NoError(t, err)
+		assert.Equal(t, tc.comments, testGerritLastReviewInput.Comments, tc.revision)
+	}
+}
+
+func TestOutFindingsPostedRobotComments(t *testing.T) {
+	delete(testGerritRobotComments, "Itestchange1")
+	defer delete(testGerritRobotComments, "Itestchange1")
+
+	for _, tc := range []struct {
+		revision string
+		posted   bool
+	}{
+		{"deadbeef0", true},
+		// The finding was already posted on patch set 1.
+		{"deadbeef0", false},
+		// It is still there in patch set 2.
+		{"deadbeef1", true},
+		{"deadbeef1", false},
+	} {
+		testGerritLastReviewInput = nil
+		err := testOutFindingsWithVersion(t,
+			Version{ChangeId: "Itestchange1", Revision: tc.revision},
+			map[string]string{"build.log": "main.go:3: Unused\n"},
+			outParams{Findings: []string{"build.log"}, RobotId: "lint", RobotRunId: "1"})
+		assert.NoError(t, err)
+		if tc.posted {
+			assert.Len(t, testGerritLastReviewInput.RobotComments["main.go"], 1, tc.revision)
+		} else {
+			assert.Empty(t, testGerritLastReviewInput.RobotComments, tc.revision)
+		}
+	}
+}
+
+func TestOutFindingsInvalid(t *testing.T) {
+	for _, params := range []outParams{
+		{Findings: []string{"missing.sarif"}},
+		{Findings: []string{"build.log"}, FindingsSeverity: "fatal"},
+		{Findings: []string{"build.log"}, MaxComments: -1},
+	} {
+		err := testOutFindings(t, map[string]string{"build.log": testCompilerOutput}, params)
+		assert.Error(t, err, "%+v", params)
+	}
+}
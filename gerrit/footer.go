@@ -0,0 +1,133 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	footersFilename = "footers.json"
+)
+
+var (
+	footerLinePattern = regexp.MustCompile(`^([A-Za-z0-9-]+):\s*(.*)$`)
+)
+
+// Footers maps commit message footer keys to their values, e.g.
+// "Skip-CI: true" is {"Skip-CI": ["true"]}.
+type Footers map[string][]string
+
+// parseFooters parses footers from the last paragraph of a commit message.
+// If any line of the last paragraph isn't a footer, there are no footers.
+func parseFooters(message string) Footers {
+	// The subject line is never a footer.
+	paragraphs := strings.Split(strings.TrimSpace(message), "\n\n")
+	if len(paragraphs) < 2 {
+		return nil
+	}
+	lastParagraph := paragraphs[len(paragraphs)-1]
+
+	footers := make(Footers)
+	var lastKey string
+	for _, line := range strings.Split(lastParagraph, "\n") {
+		// Lines starting with whitespace continue the previous footer.
+		if lastKey != "" && strings.TrimLeft(line, " \t") != line {
+			values := footers[lastKey]
+			values[len(values)-1] += " " + strings.TrimSpace(line)
+			continue
+		}
+		match := footerLinePattern.FindStringSubmatch(line)
+		if match == nil {
+			return nil
+		}
+		lastKey = match[1]
+		footers[lastKey] = append(footers[lastKey], strings.TrimSpace(match[2]))
+	}
+	return footers
+}
+
+// WriteToFile writes the footers as a JSON object.
+func (f Footers) WriteToFile(path string) error {
+	if f == nil {
+		f = Footers{}
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return json.NewEncoder(file).Encode(f)
+}
+
+// Lines returns the footers as "Key: value" lines, sorted by key.
+func (f Footers) Lines() []string {
+	var keys []string
+	for key := range f {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var lines []string
+	for _, key := range keys {
+		for _, value := range f[key] {
+			lines = append(lines, fmt.Sprintf("%s: %s", key, value))
+		}
+	}
+	return lines
+}
+
+// Get returns the values of a footer; keys are case insensitive.
+func (f Footers) Get(key string) []string {
+	var values []string
+	for k, v := range f {
+		if strings.EqualFold(k, key) {
+			values = append(values, v...)
+		}
+	}
+	return values
+}
+
+// matches reports whether any value of the footer with the given key matches
+// pattern. Patterns must match the whole value and are case insensitive.
+func (f Footers) matches(key string, pattern string) (bool, error) {
+	re, err := regexp.Compile(fmt.Sprintf("^(?i:%s)$", pattern))
+	if err != nil {
+		return false, fmt.Errorf("invalid footer pattern %q: %v", pattern, err)
+	}
+	for _, value := range f.Get(key) {
+		if re.MatchString(value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// validateFooterRules returns an error if any footer rule pattern is invalid.
+func validateFooterRules(src Source) error {
+	for _, rules := range []map[string]string{src.IncludeFooters, src.ExcludeFooters} {
+		for key, pattern := range rules {
+			_, err := Footers{}.matches(key, pattern)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFooters(t *testing.T) {
+	footers := parseFooters("Subject\n\nBody: not a footer\n\nSkip-CI: true\nBug: 1\nBug: 2\n  continued\nChange-Id: Iabc\n")
+	assert.Equal(t, Footers{
+		"Skip-CI":   {"true"},
+		"Bug":       {"1", "2 continued"},
+		"Change-Id": {"Iabc"},
+	}, footers)
+	assert.Equal(t, []string{"true"}, footers.Get("skip-ci"))
+	assert.Equal(t, []string{"Bug: 1", "Bug: 2 continued", "Change-Id: Iabc", "Skip-CI: true"}, footers.Lines())
+}
+
+func TestParseFootersNone(t *testing.T) {
+	assert.Empty(t, parseFooters("Subject: with colon"))
+	assert.Empty(t, parseFooters("Subject\n\nBody text\nSkip-CI: true"))
+}
+
+func TestFootersMatches(t *testing.T) {
+	footers := Footers{"CI-Pipelines": {"fast"}}
+	match, err := footers.matches("ci-pipelines", "FAST|slow")
+	assert.NoError(t, err)
+	assert.True(t, match)
+
+	match, err = footers.matches("CI-Pipelines", "fas")
+	assert.NoError(t, err)
+	assert.False(t, match)
+
+	_, err = footers.matches("CI-Pipelines", "(")
+	assert.Error(t, err)
+}
@@ -15,29 +15,417 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
 	"golang.org/x/build/gerrit"
 )
 
-func gerritClient(src Source, authMan *authManager) (*gerrit.Client, error) {
+var (
+	errAnonymous = errors.New("not authenticated")
+)
+
+// gerritService is the Gerrit API used by check, in and out. It is
+// implemented over REST by gerritApi and over SSH by gerritSsh.
+type gerritService interface {
+	queryChanges(ctx context.Context, query string, opt gerrit.QueryChangesOpt) ([]*changeInfo, error)
+	getChange(ctx context.Context, changeId string, fields ...string) (*changeInfo, error)
+	getRelatedChanges(ctx context.Context, changeId string, revision string) ([]relatedChangeInfo, error)
+	getMergeable(ctx context.Context, changeId string, revision string) (bool, error)
+	getRevisionLabels(ctx context.Context, changeId string, revision string) (map[string]gerrit.LabelInfo, error)
+	setReview(ctx context.Context, changeId string, revision string, review reviewInput) error
+	getPatch(ctx context.Context, changeId string, revision string) ([]byte, error)
+	getComments(ctx context.Context, changeId string) (map[string][]commentInfo, error)
+	getRobotComments(ctx context.Context, changeId string) (map[string][]commentInfo, error)
+	getSelf(ctx context.Context) (*gerrit.AccountInfo, error)
+}
+
+// gerritApi is a gerritService using Gerrit's REST API.
+type gerritApi struct {
+	url        string
+	authMan    *authManager
+	httpClient *http.Client
+}
+
+// changeInfo extends gerrit.ChangeInfo with fields it lacks.
+type changeInfo struct {
+	gerrit.ChangeInfo
+	Topic string `json:"topic"`
+	// Whether the current revision is mergeable, if the server computes it
+	// when indexing changes.
+	Mergeable *bool `json:"mergeable"`
+}
+
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#related-change-and-commit-info
+type relatedChangeInfo struct {
+	ChangeId              string            `json:"change_id"`
+	Commit                gerrit.CommitInfo `json:"commit"`
+	ChangeNumber          int               `json:"_change_number"`
+	RevisionNumber        int               `json:"_revision_number"`
+	CurrentRevisionNumber int               `json:"_current_revision_number"`
+	Status                string            `json:"status"`
+}
+
+// reviewInput replaces gerrit.ReviewInput, which lacks comment ranges and
+// resolution.
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#review-input
+type reviewInput struct {
+	Message       string                         `json:"message,omitempty"`
+	Labels        map[string]int                 `json:"labels,omitempty"`
+	Comments      map[string][]commentInput      `json:"comments,omitempty"`
+	RobotComments map[string][]robotCommentInput `json:"robot_comments,omitempty"`
+}
+
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#comment-input
+type commentInput struct {
+	Line       int           `json:"line,omitempty"`
+	Range      *commentRange `json:"range,omitempty"`
+	Message    string        `json:"message"`
+	Unresolved bool          `json:"unresolved,omitempty"`
+
+	// Only robot comments may have fix suggestions.
+	FixSuggestions []fixSuggestionInfo `json:"fix_suggestions,omitempty"`
+}
+
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#robot-comment-input
+type robotCommentInput struct {
+	commentInput
+	RobotId    string `json:"robot_id"`
+	RobotRunId string `json:"robot_run_id"`
+	Url        string `json:"url,omitempty"`
+}
+
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#fix-suggestion-info
+type fixSuggestionInfo struct {
+	Description  string               `json:"description"`
+	Replacements []fixReplacementInfo `json:"replacements"`
+}
+
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#fix-replacement-info
+type fixReplacementInfo struct {
+	Path        string       `json:"path"`
+	Range       commentRange `json:"range"`
+	Replacement string       `json:"replacement"`
+}
+
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#comment-info
+type commentInfo struct {
+	Id         string              `json:"id"`
+	Path       string              `json:"path,omitempty"`
+	PatchSet   int                 `json:"patch_set,omitempty"`
+	Line       int                 `json:"line,omitempty"`
+	Range      *commentRange       `json:"range,omitempty"`
+	InReplyTo  string              `json:"in_reply_to,omitempty"`
+	Message    string              `json:"message,omitempty"`
+	Updated    gerrit.TimeStamp    `json:"updated"`
+	Author     *gerrit.AccountInfo `json:"author,omitempty"`
+	Unresolved bool                `json:"unresolved"`
+}
+
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#comment-range
+type commentRange struct {
+	StartLine      int `json:"start_line"`
+	StartCharacter int `json:"start_character"`
+	EndLine        int `json:"end_line"`
+	EndCharacter   int `json:"end_character"`
+}
+
+func gerritClient(src Source, authMan *authManager) (gerritService, error) {
+	if src.SshUrl != "" {
+		return newGerritSsh(src, authMan)
+	}
 	if src.Url == "" {
 		return nil, fmt.Errorf("source url is required")
 	}
-	auth, err := authMan.gerritAuth()
+	transport, err := authMan.httpTransport()
+	if err != nil {
+		return nil, err
+	}
+	authMan.tokenClient = &http.Client{Transport: transport}
+	return &gerritApi{
+		url:        strings.TrimSuffix(src.Url, "/"),
+		authMan:    authMan,
+		httpClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+// useCache makes GET requests conditional on cached responses' ETags.
+func (c *gerritApi) useCache(cache *responseCache) {
+	c.httpClient.Transport = &cachingTransport{
+		cache: cache,
+		base:  c.httpClient.Transport,
+	}
+}
+
+// queryChanges is like gerrit.Client.QueryChanges but returns changeInfos.
+func (c *gerritApi) queryChanges(
+	ctx context.Context,
+	query string,
+	opt gerrit.QueryChangesOpt,
+) ([]*changeInfo, error) {
+	values := url.Values{"q": {query}, "o": opt.Fields}
+	if opt.N != 0 {
+		values.Set("n", strconv.Itoa(opt.N))
+	}
+	var changes []*changeInfo
+	err := c.do(ctx, &changes, "GET", "/changes/", values, nil)
+	return changes, err
+}
+
+// getChange is like gerrit.Client.GetChange but returns a changeInfo.
+func (c *gerritApi) getChange(
+	ctx context.Context,
+	changeId string,
+	fields ...string,
+) (*changeInfo, error) {
+	var change changeInfo
+	err := c.do(ctx, &change, "GET", "/changes/"+changeId,
+		url.Values{"o": fields}, nil)
+	return &change, err
+}
+
+func (c *gerritApi) getRelatedChanges(
+	ctx context.Context,
+	changeId string,
+	revision string,
+) ([]relatedChangeInfo, error) {
+	var related struct {
+		Changes []relatedChangeInfo `json:"changes"`
+	}
+	err := c.do(ctx, &related, "GET",
+		fmt.Sprintf("/changes/%s/revisions/%s/related", changeId, revision),
+		nil, nil)
+	return related.Changes, err
+}
+
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#get-mergeable
+func (c *gerritApi) getMergeable(
+	ctx context.Context,
+	changeId string,
+	revision string,
+) (bool, error) {
+	var info struct {
+		Mergeable bool `json:"mergeable"`
+	}
+	err := c.do(ctx, &info, "GET",
+		fmt.Sprintf("/changes/%s/revisions/%s/mergeable", changeId, revision),
+		nil, nil)
+	return info.Mergeable, err
+}
+
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#get-review
+func (c *gerritApi) getRevisionLabels(
+	ctx context.Context,
+	changeId string,
+	revision string,
+) (map[string]gerrit.LabelInfo, error) {
+	var change changeInfo
+	err := c.do(ctx, &change, "GET",
+		fmt.Sprintf("/changes/%s/revisions/%s/review", changeId, revision),
+		nil, nil)
+	return change.Labels, err
+}
+
+func (c *gerritApi) setReview(
+	ctx context.Context,
+	changeId string,
+	revision string,
+	review reviewInput,
+) error {
+	var result struct{}
+	return c.do(ctx, &result, "POST",
+		fmt.Sprintf("/changes/%s/revisions/%s/review", changeId, revision),
+		nil, review)
+}
+
+// getComments returns the published inline comments of a change by path.
+func (c *gerritApi) getComments(
+	ctx context.Context,
+	changeId string,
+) (map[string][]commentInfo, error) {
+	return c.listComments(ctx, changeId, "comments")
+}
+
+// getRobotComments returns the robot comments of a change by path, without
+// robot specific fields.
+func (c *gerritApi) getRobotComments(
+	ctx context.Context,
+	changeId string,
+) (map[string][]commentInfo, error) {
+	return c.listComments(ctx, changeId, "robotcomments")
+}
+
+func (c *gerritApi) listComments(
+	ctx context.Context,
+	changeId string,
+	kind string,
+) (map[string][]commentInfo, error) {
+	var comments map[string][]commentInfo
+	err := c.do(ctx, &comments, "GET",
+		fmt.Sprintf("/changes/%s/%s", changeId, kind), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	for path, pathComments := range comments {
+		for i := range pathComments {
+			pathComments[i].Path = path
+		}
+	}
+	return comments, nil
+}
+
+// getSelf returns the account the client is authenticated as.
+func (c *gerritApi) getSelf(ctx context.Context) (*gerrit.AccountInfo, error) {
+	if !c.authMan.authenticated() {
+		return nil, errAnonymous
+	}
+	var account gerrit.AccountInfo
+	err := c.do(ctx, &account, "GET", "/accounts/self", nil, nil)
 	if err != nil {
 		return nil, err
 	}
-	return gerrit.NewClient(src.Url, auth), nil
+	return &account, nil
+}
 
+// getPatch returns the diff of a revision against its parent, formatted like
+// "git format-patch".
+// See: https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#get-patch
+func (c *gerritApi) getPatch(
+	ctx context.Context,
+	changeId string,
+	revision string,
+) ([]byte, error) {
+	resp, err := c.send(ctx, "GET",
+		fmt.Sprintf("/changes/%s/revisions/%s/patch", changeId, revision),
+		nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, fmt.Errorf("HTTP status %s; %s", resp.Status, body)
+	}
+	// The patch is base64 encoded.
+	return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, resp.Body))
+}
+
+// do makes a Gerrit REST API request, decoding the response into dst.
+func (c *gerritApi) do(
+	ctx context.Context,
+	dst interface{},
+	method string,
+	path string,
+	values url.Values,
+	body interface{},
+) error {
+	var bodyData []byte
+	if body != nil {
+		var err error
+		bodyData, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	resp, err := c.send(ctx, method, path, values, bodyData)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, dst)
+}
+
+// send makes a Gerrit REST API request with an optional JSON body. The caller
+// must close the response body.
+func (c *gerritApi) send(
+	ctx context.Context,
+	method string,
+	path string,
+	values url.Values,
+	bodyData []byte,
+) (*http.Response, error) {
+	// See: https://gerrit-review.googlesource.com/Documentation/rest-api.html#authentication
+	u := c.url
+	if c.authMan.authenticated() {
+		u += "/a"
+	}
+	u += path
+	if len(values) > 0 {
+		u += "?" + values.Encode()
+	}
+
+	var challenge string
+	retried := false
+	for {
+		req, err := http.NewRequest(method, u, bytes.NewReader(bodyData))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if bodyData != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		err = c.authMan.setRequestAuth(req, challenge)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		// Digest auth requires a challenge from the server, and requested
+		// tokens may have been revoked early; retry once.
+		if resp.StatusCode == http.StatusUnauthorized && !retried {
+			if c.authMan.digest {
+				challenge = resp.Header.Get("WWW-Authenticate")
+				retried = challenge != ""
+			} else {
+				retried = c.authMan.expireToken()
+			}
+			if retried {
+				resp.Body.Close()
+				continue
+			}
+		}
+		return resp, nil
+	}
+}
+
+func decodeResponse(resp *http.Response, dst interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("HTTP status %s; %s", resp.Status, body)
+	}
+
+	// The JSON response begins with an XSRF-defeating header.
+	br := bufio.NewReader(resp.Body)
+	_, err := br.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(br).Decode(dst)
 }
 
 func getVersionChangeRevision(
-	client *gerrit.Client,
+	client gerritService,
 	ctx context.Context,
 	ver Version,
 	extraFields ...string,
-) (*gerrit.ChangeInfo, *gerrit.RevisionInfo, error) {
+) (*changeInfo, *gerrit.RevisionInfo, error) {
 	if ver.ChangeId == "" {
 		return nil, nil, fmt.Errorf("version change_id required")
 	}
@@ -45,11 +433,8 @@ func getVersionChangeRevision(
 		return nil, nil, fmt.Errorf("version revision required")
 	}
 
-	change, err := client.GetChange(
-		ctx, ver.ChangeId,
-		gerrit.QueryChangesOpt{
-			Fields: append([]string{"ALL_REVISIONS", "DETAILED_ACCOUNTS"}, extraFields...),
-		})
+	change, err := client.getChange(
+		ctx, ver.ChangeId, append([]string{"ALL_REVISIONS"}, extraFields...)...)
 	if err != nil {
 		return nil, nil, fmt.Errorf(
 			"error getting change %q: %v", ver.ChangeId, err)
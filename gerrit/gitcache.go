@@ -0,0 +1,143 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// objectCache is a bare mirror of a remote repository in a persistent cache
+// directory, which repositories fetching from the same remote borrow objects
+// from through git alternates.
+type objectCache struct {
+	path string
+	lock *os.File
+}
+
+func objectCachePath(cacheDir string, fetchUrl string) string {
+	sum := sha1.Sum([]byte(fetchUrl))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".git")
+}
+
+// openObjectCache locks the mirror of fetchUrl in cacheDir and fetches refs
+// into it, creating it if needed. The mirror stays locked for reading until
+// close is called, so concurrent updates can't interfere with its use.
+func openObjectCache(
+	cacheDir string,
+	fetchUrl string,
+	configArgs map[string]string,
+	env []string,
+	refs []string,
+) (*objectCache, error) {
+	cache := &objectCache{path: objectCachePath(cacheDir, fetchUrl)}
+
+	err := os.MkdirAll(cacheDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	cache.lock, err = os.OpenFile(cache.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(cache.lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		cache.lock.Close()
+		return nil, fmt.Errorf("error locking object cache: %v", err)
+	}
+
+	err = cache.update(cacheDir, fetchUrl, configArgs, env, refs)
+	if err == nil {
+		// Allow other readers now that the mirror is up to date.
+		err = syscall.Flock(int(cache.lock.Fd()), syscall.LOCK_SH)
+	}
+	if err != nil {
+		cache.close()
+		return nil, err
+	}
+	return cache, nil
+}
+
+func (oc *objectCache) update(
+	cacheDir string,
+	fetchUrl string,
+	configArgs map[string]string,
+	env []string,
+	refs []string,
+) error {
+	if _, err := os.Stat(oc.path); os.IsNotExist(err) {
+		err = git(cacheDir, "init", "--bare", oc.path)
+		if err != nil {
+			return err
+		}
+		err = git(oc.path, "remote", "add", "origin", fetchUrl)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Auth config refers to temp files, so it is set again every time.
+	for key, value := range configArgs {
+		err := git(oc.path, "config", key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep refs in the mirror so their objects aren't garbage collected.
+	args := []string{"fetch", "origin"}
+	for _, ref := range refs {
+		args = append(args, fmt.Sprintf("+%s:%s", ref, ref))
+	}
+	return gitWithEnv(oc.path, env, args...)
+}
+
+// borrow makes the git repo in dir use objects from the mirror.
+// See: https://git-scm.com/docs/gitrepository-layout#Documentation/gitrepository-layout.txt-objectsinfoalternates
+func (oc *objectCache) borrow(dir string) error {
+	objectsDir, err := filepath.Abs(filepath.Join(oc.path, "objects"))
+	if err != nil {
+		return err
+	}
+	alternatesPath := filepath.Join(dir, ".git", "objects", "info", "alternates")
+	err = os.MkdirAll(filepath.Dir(alternatesPath), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(alternatesPath, []byte(objectsDir+"\n"), 0644)
+}
+
+// dissociate copies borrowed objects into the git repo in dir, so it no longer
+// depends on the mirror, like "git clone --dissociate".
+func dissociate(dir string) error {
+	err := git(dir, "repack", "-a", "-d")
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, ".git", "objects", "info", "alternates"))
+}
+
+func (oc *objectCache) close() {
+	err := oc.lock.Close()
+	if err != nil {
+		log.Printf("error unlocking object cache: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRealGitRepo creates a git repo with a commit of the given files (and
+// file.txt) at the ref of test change 1, and makes in use real git until the
+// returned func is called.
+func testRealGitRepo(t *testing.T, files map[string]string) (string, func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo, err := ioutil.TempDir(testTempDir, "remote")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, "file.txt"), []byte("contents"), 0644))
+	for name, contents := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, name), []byte(contents), 0644))
+	}
+	for _, args := range [][]string{
+		{"init"},
+		{"add", "."},
+		{"-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-m", "Test"},
+		{"update-ref", "refs/changes/1/1/1", "HEAD"},
+	} {
+		output, err := realExecGit(nil, append([]string{"-C", repo}, args...)...)
+		assert.NoError(t, err, string(output))
+	}
+
+	commit, err := realExecGit(nil, "-C", repo, "rev-parse", "HEAD")
+	assert.NoError(t, err, string(commit))
+
+	// The test server calls the commit by its test revision.
+	origExecGit := execGit
+	execGit = func(env []string, args ...string) ([]byte, error) {
+		output, err := realExecGit(env, args...)
+		if args[2] == "rev-parse" && string(output) == string(commit) {
+			output = []byte(testRevisionPrefix + "0")
+		}
+		return output, err
+	}
+	return repo, func() { execGit = origExecGit }
+}
+
+func TestInObjectCache(t *testing.T) {
+	repo, restore := testRealGitRepo(t, nil)
+	defer restore()
+	cacheDir := filepath.Join(testTempDir, "cache")
+	params := inParams{FetchUrl: repo, CacheDir: cacheDir}
+
+	for i := 0; i < 2; i++ {
+		testIn(t, Source{}, testInVersion, params)
+
+		data, err := ioutil.ReadFile(filepath.Join(testInDestDir, "file.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "contents", string(data))
+
+		// Borrowed objects are copied into the repo.
+		_, err = os.Stat(filepath.Join(testInDestDir, ".git", "objects", "info", "alternates"))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// The mirror keeps the fetched ref.
+	output, err := realExecGit(nil, "-C", objectCachePath(cacheDir, repo),
+		"rev-parse", "--verify", "refs/changes/1/1/1")
+	assert.NoError(t, err, string(output))
+
+	// The repo still works without the mirror.
+	assert.NoError(t, os.RemoveAll(cacheDir))
+	output, err = realExecGit(nil, "-C", testInDestDir, "fsck")
+	assert.NoError(t, err, string(output))
+}
+
+func TestInObjectCacheKeepAlternates(t *testing.T) {
+	repo, restore := testRealGitRepo(t, nil)
+	defer restore()
+	cacheDir := filepath.Join(testTempDir, "cache")
+
+	testIn(t, Source{}, testInVersion, inParams{
+		FetchUrl:       repo,
+		CacheDir:       cacheDir,
+		KeepAlternates: true,
+	})
+	alternates, err := ioutil.ReadFile(
+		filepath.Join(testInDestDir, ".git", "objects", "info", "alternates"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(objectCachePath(cacheDir, repo), "objects"),
+		strings.TrimSpace(string(alternates)))
+	assert.NoError(t, os.RemoveAll(cacheDir))
+}
+
+func TestInTrackedResourceFiles(t *testing.T) {
+	// The repo tracks files with the names of files written by in.
+	tracked := map[string]string{
+		filesFilename:          "tracked files",
+		patchFilename:          "tracked patch",
+		footersFilename:        "tracked footers",
+		messagesFilename:       "tracked messages",
+		commentsFilename:       "tracked comments",
+		gerritEnvFilename:      "tracked env",
+		relatedChangesFilename: "tracked related changes",
+	}
+	repo, restore := testRealGitRepo(t, tracked)
+	defer restore()
+
+	testIn(t, Source{}, testInVersion, inParams{FetchUrl: repo, IncludeComments: true})
+	for name, contents := range tracked {
+		data, err := ioutil.ReadFile(filepath.Join(testInDestDir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, contents, string(data), name)
+		_, err = os.Stat(testResourceFile(name))
+		assert.NoError(t, err, name)
+	}
+
+	// The worktree is clean.
+	output, err := realExecGit(nil, "-C", testInDestDir, "status", "--porcelain")
+	assert.NoError(t, err, string(output))
+	assert.Empty(t, string(output))
+}
+
+func TestRealExecGitStderr(t *testing.T) {
+	repo, restore := testRealGitRepo(t, nil)
+	restore()
+
+	// Only stdout is returned, even if git writes to stderr.
+	head, err := realExecGit(nil, "-C", repo, "rev-parse", "HEAD")
+	assert.NoError(t, err)
+	traced, err := realExecGit([]string{"GIT_TRACE=1"}, "-C", repo, "rev-parse", "HEAD")
+	assert.NoError(t, err)
+	assert.Equal(t, string(head), string(traced))
+
+	// stderr is in the error.
+	_, err = realExecGit(nil, "-C", repo, "rev-parse", "--verify", "missing")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "fatal:")
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/build/gerrit"
+)
+
+const (
+	groupByTopic         = "topic"
+	groupByRelationChain = "relation_chain"
+)
+
+// groupMembers returns the member versions of a grouped version.
+//
+// Members are encoded in Version.Members as "<change id> <revision>" pairs
+// separated by commas, since Concourse versions may only contain strings.
+func (v Version) groupMembers() ([]Version, error) {
+	var members []Version
+	for _, member := range strings.Split(v.Members, ",") {
+		fields := strings.Fields(member)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid group member %q", member)
+		}
+		members = append(members, Version{ChangeId: fields[0], Revision: fields[1]})
+	}
+	return members, nil
+}
+
+// groupMember is a change in a group, at the revision that belongs to it.
+type groupMember struct {
+	change   *changeInfo
+	revision string
+}
+
+// groupVersions translates changes into versions of the groups they belong to.
+// Member changes are fetched with the given extra fields and also returned,
+// keyed by change ID.
+func groupVersions(
+	c gerritService,
+	ctx context.Context,
+	src Source,
+	query string,
+	changes []*changeInfo,
+	extraFields []string,
+) (VersionList, map[string]*changeInfo, error) {
+	versions := VersionList{}
+	memberChanges := make(map[string]*changeInfo)
+	for _, change := range changes {
+		if memberChanges[change.ID] != nil {
+			continue
+		}
+		group, members, err := changeGroup(c, ctx, src, query, change, extraFields)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting group of change %q: %v", change.ID, err)
+		}
+		for _, member := range members {
+			memberChanges[member.change.ID] = member.change
+		}
+		if len(members) > 0 {
+			versions = append(versions, groupVersion(group, members))
+		}
+	}
+	return versions, memberChanges, nil
+}
+
+// changeGroup returns the group name and open members of the group containing
+// the given change. Changes not in any group form a group by themselves. Only
+// changes matching query are members.
+func changeGroup(
+	c gerritService,
+	ctx context.Context,
+	src Source,
+	query string,
+	change *changeInfo,
+	extraFields []string,
+) (string, []groupMember, error) {
+	singleton := []groupMember{{change, change.CurrentRevision}}
+	switch src.GroupBy {
+	case groupByTopic:
+		if change.Topic == "" {
+			return "change:" + change.ID, singleton, nil
+		}
+		changes, err := c.queryChanges(ctx,
+			fmt.Sprintf("(%s) AND topic:%q", query, change.Topic),
+			gerrit.QueryChangesOpt{Fields: append([]string{"CURRENT_REVISION"}, extraFields...)})
+		var members []groupMember
+		for _, member := range changes {
+			members = append(members, groupMember{member, member.CurrentRevision})
+		}
+		return "topic:" + change.Topic, members, err
+
+	case groupByRelationChain:
+		related, err := c.getRelatedChanges(ctx, change.ID, change.CurrentRevision)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(related) == 0 {
+			return "change:" + change.ID, singleton, nil
+		}
+
+		// Members are at the revision in the chain, which may not be current, so
+		// all revisions are needed.
+		var numbers []string
+		for _, relatedChange := range related {
+			if relatedChange.Status == "" || relatedChange.Status == "NEW" {
+				numbers = append(numbers, fmt.Sprintf("change:%d", relatedChange.ChangeNumber))
+			}
+		}
+		if len(numbers) == 0 {
+			return "change:" + change.ID, singleton, nil
+		}
+		changes, err := c.queryChanges(ctx,
+			fmt.Sprintf("(%s) AND (%s)", query, strings.Join(numbers, " OR ")),
+			gerrit.QueryChangesOpt{Fields: append([]string{"ALL_REVISIONS"}, extraFields...)})
+		if err != nil {
+			return "", nil, err
+		}
+		matching := make(map[int]*changeInfo)
+		for _, member := range changes {
+			matching[member.ChangeNumber] = member
+		}
+
+		// Related changes are ordered from descendants to ancestors; the group is
+		// named after the oldest open ancestor.
+		var members []groupMember
+		rootNumber := 0
+		for _, relatedChange := range related {
+			member := matching[relatedChange.ChangeNumber]
+			if member == nil {
+				continue
+			}
+			for revision, rev := range member.Revisions {
+				if rev.PatchSetNumber == relatedChange.RevisionNumber {
+					members = append(members, groupMember{member, revision})
+					rootNumber = relatedChange.ChangeNumber
+					break
+				}
+			}
+		}
+		if len(members) == 0 {
+			return "change:" + change.ID, singleton, nil
+		}
+		return fmt.Sprintf("relation_chain:%d", rootNumber), members, nil
+
+	default:
+		return "", nil, fmt.Errorf("unsupported group_by %q", src.GroupBy)
+	}
+}
+
+// groupVersion builds a version from the revisions of group members.
+func groupVersion(group string, members []groupMember) Version {
+	ver := Version{Group: group}
+	var memberStrings []string
+	for _, member := range members {
+		rev, ok := member.change.Revisions[member.revision]
+		if !ok {
+			continue
+		}
+		if rev.Created.Time().After(ver.Created) {
+			ver = newVersion(member.change, member.revision)
+			ver.Group = group
+		}
+		memberStrings = append(memberStrings,
+			fmt.Sprintf("%s %s", member.change.ID, member.revision))
+	}
+	sort.Strings(memberStrings)
+	ver.Members = strings.Join(memberStrings, ",")
+	return ver
+}
+
+// requestedGroupChanges returns the current state of the member changes of a
+// requested grouped version, with the given fields.
+func requestedGroupChanges(
+	c gerritService,
+	ctx context.Context,
+	ver Version,
+	fields []string,
+) ([]*changeInfo, error) {
+	members, err := ver.groupMembers()
+	if err != nil {
+		return nil, err
+	}
+	var changes []*changeInfo
+	for _, member := range members {
+		change, err := c.getChange(ctx, member.ChangeId, fields...)
+		if err != nil {
+			return nil, fmt.Errorf("error getting group member %q: %v", member.ChangeId, err)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// groupChanged reports whether groupVer is a new set of revisions of the group
+// of the requested version ver, i.e. they share a member change but differ in
+// members.
+func groupChanged(groupVer Version, ver Version) bool {
+	if ver.Members == "" || groupVer.Members == ver.Members {
+		return false
+	}
+	if groupVer.Group == ver.Group {
+		return true
+	}
+	requested := make(map[string]bool)
+	for _, member := range strings.Split(ver.Members, ",") {
+		requested[strings.SplitN(member, " ", 2)[0]] = true
+	}
+	for _, member := range strings.Split(groupVer.Members, ",") {
+		if requested[strings.SplitN(member, " ", 2)[0]] {
+			return true
+		}
+	}
+	return false
+}
+
+// groupUpdated returns the newest update time of the members of groupVer and
+// of the given former members. A change joining or leaving a group updates it,
+// so this is no earlier than when the group's members last changed.
+func groupUpdated(
+	groupVer Version,
+	memberChanges map[string]*changeInfo,
+	formerChanges []*changeInfo,
+) time.Time {
+	updated := groupVer.Created
+	changes := formerChanges
+	if members, err := groupVer.groupMembers(); err == nil {
+		for _, member := range members {
+			if change := memberChanges[member.ChangeId]; change != nil {
+				changes = append(changes, change)
+			}
+		}
+	}
+	for _, change := range changes {
+		if change.Updated.Time().After(updated) {
+			updated = change.Updated.Time()
+		}
+	}
+	return updated
+}
+
+// tipLast orders revisions by creation time, except that the newest revision
+// that isn't a parent of any of the others is last.
+func tipLast(revs map[string]*gerrit.RevisionInfo) []string {
+	parents := make(map[string]bool)
+	var sorted []string
+	for revision, rev := range revs {
+		if rev.Commit != nil {
+			for _, parent := range rev.Commit.Parents {
+				parents[parent.CommitID] = true
+			}
+		}
+		sorted = append(sorted, revision)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return revs[sorted[i]].Created.Time().Before(revs[sorted[j]].Created.Time())
+	})
+
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if !parents[sorted[i]] {
+			return append(append(sorted[:i:i], sorted[i+1:]...), sorted[i])
+		}
+	}
+	return sorted
+}
+
+// confirmVersion returns an error if any revision in ver no longer exists.
+func confirmVersion(c gerritService, ctx context.Context, ver Version) error {
+	if ver.Members == "" {
+		_, _, err := getVersionChangeRevision(c, ctx, ver)
+		return err
+	}
+	members, err := ver.groupMembers()
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		_, _, err = getVersionChangeRevision(c, ctx, member)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
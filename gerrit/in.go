@@ -15,14 +15,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/build/gerrit"
 
@@ -31,6 +34,8 @@ import (
 
 const (
 	gerritVersionFilename = ".gerrit_version.json"
+	// Other files written by in go in this directory.
+	resourceDirname = ".gerrit"
 )
 
 var (
@@ -43,6 +48,107 @@ var (
 type inParams struct {
 	FetchProtocol string `json:"fetch_protocol"`
 	FetchUrl      string `json:"fetch_url"`
+	Checkout      string `json:"checkout"`
+
+	// Create a local branch for each ancestor in the relation chain.
+	RelatedBranches bool `json:"related_branches"`
+
+	Depth     int    `json:"depth"`
+	Filter    string `json:"filter"`
+	FetchTags bool   `json:"fetch_tags"`
+
+	Submodules         string `json:"submodules"`
+	SubmoduleDepth     int    `json:"submodule_depth"`
+	SubmodulesTopLevel bool   `json:"submodules_top_level"`
+
+	// Borrow objects from a mirror of the remote kept in CacheDir. Borrowed
+	// objects are copied into the repo unless KeepAlternates is set.
+	CacheDir       string `json:"cache_dir"`
+	KeepAlternates bool   `json:"keep_alternates"`
+
+	Lfs lfsParam `json:"lfs"`
+
+	// Write the diff from this patch set to the fetched one to interdiff.patch.
+	InterdiffPatchSet int `json:"interdiff_patch_set"`
+
+	// Write change messages and inline comments.
+	IncludeComments bool `json:"include_comments"`
+
+	// Only query Gerrit, without fetching the repository.
+	SkipDownload bool `json:"skip_download"`
+
+	// Require fetched revisions to be signed by a key in the source's
+	// signing_keys or allowed_signers.
+	VerifySignatures bool `json:"verify_signatures"`
+}
+
+const (
+	submodulesNone      = "none"
+	submodulesShallow   = "shallow"
+	submodulesRecursive = "recursive"
+)
+
+func (p inParams) validate(src Source) error {
+	err := validateCheckout(p.Checkout)
+	if err != nil {
+		return err
+	}
+	switch p.Submodules {
+	case "", submodulesNone, submodulesShallow, submodulesRecursive:
+	default:
+		return fmt.Errorf("unsupported submodules %q", p.Submodules)
+	}
+	if p.Depth < 0 || p.SubmoduleDepth < 0 {
+		return fmt.Errorf("depth and submodule_depth must not be negative")
+	}
+	// The target branch is fetched with the same depth, which may leave out the
+	// merge base or the ancestors of related changes.
+	if p.Depth > 0 && (p.Checkout == checkoutMerge || p.Checkout == checkoutRebase ||
+		p.RelatedBranches) {
+		return fmt.Errorf("depth can't be used with checkout %q or related_branches", p.Checkout)
+	}
+	if p.SkipDownload && (p.RelatedBranches || p.InterdiffPatchSet != 0 || p.VerifySignatures) {
+		return fmt.Errorf("related_branches, interdiff_patch_set and verify_signatures require a download")
+	}
+	if src.GroupBy != "" && (p.IncludeComments || p.InterdiffPatchSet != 0 || p.RelatedBranches) {
+		return fmt.Errorf("include_comments, interdiff_patch_set and related_branches can't be used with group_by")
+	}
+	return nil
+}
+
+// fetchArgs returns the options for fetching revisions.
+func (p inParams) fetchArgs() []string {
+	var args []string
+	if p.Depth > 0 {
+		args = append(args, fmt.Sprintf("--depth=%d", p.Depth))
+	}
+	if p.Filter != "" {
+		args = append(args, "--filter="+p.Filter)
+	}
+	if p.FetchTags {
+		args = append(args, "--tags")
+	}
+	return args
+}
+
+// submoduleArgs returns the arguments for updating submodules, or nil if
+// submodules shouldn't be updated.
+func (p inParams) submoduleArgs() []string {
+	if p.Submodules == submodulesNone {
+		return nil
+	}
+	args := []string{"submodule", "update", "--init"}
+	if !p.SubmodulesTopLevel {
+		args = append(args, "--recursive")
+	}
+	depth := p.SubmoduleDepth
+	if depth == 0 && p.Submodules == submodulesShallow {
+		depth = 1
+	}
+	if depth > 0 {
+		args = append(args, fmt.Sprintf("--depth=%d", depth))
+	}
+	return args
 }
 
 func init() {
@@ -59,9 +165,24 @@ func in(req resource.InRequest) error {
 	}
 	dir := req.TargetDir()
 
+	err = params.validate(src)
+	if err != nil {
+		return err
+	}
+	if params.VerifySignatures && src.SigningKeys == "" && src.AllowedSigners == "" {
+		return fmt.Errorf("verify_signatures requires source signing_keys or allowed_signers")
+	}
+	if params.FetchProtocol == "" && params.FetchUrl == "" && src.SshUrl != "" {
+		// Changes queried over ssh only have ssh fetch info.
+		params.FetchProtocol = "ssh"
+	}
+
 	authMan := newAuthManager(src)
 	defer authMan.cleanup()
 
+	verifier := newSignatureVerifier(src)
+	defer verifier.cleanup()
+
 	c, err := gerritClient(src, authMan)
 	if err != nil {
 		return fmt.Errorf("error setting up gerrit client: %v", err)
@@ -69,56 +190,44 @@ func in(req resource.InRequest) error {
 
 	ctx := context.Background()
 
-	// Fetch requested version from Gerrit
-	change, rev, err := getVersionChangeRevision(c, ctx, ver, "CURRENT_COMMIT", "DETAILED_LABELS")
-	if err != nil {
-		return err
-	}
-
-	fetchUrl, fetchRef, err := resolveFetchUrlRef(params, rev)
-	if err != nil {
-		return fmt.Errorf("could not resolve fetch args for change %q: %v", change.ID, err)
+	if ver.Members != "" {
+		return inGroup(req, c, ctx, src, ver, params, authMan, verifier)
 	}
 
-	// Prepare destination repo and checkout requested revision
-	err = git(dir, "init")
-	if err != nil {
-		return err
+	// Fetch requested version from Gerrit
+	fields := []string{"DETAILED_ACCOUNTS", "ALL_COMMITS", "DETAILED_LABELS", "ALL_FILES"}
+	if params.IncludeComments {
+		fields = append(fields, "MESSAGES")
 	}
-	err = git(dir, "config", "color.ui", "always")
+	change, rev, err := getVersionChangeRevision(c, ctx, ver, fields...)
 	if err != nil {
 		return err
 	}
 
-	configArgs, err := authMan.gitConfigArgs()
-	if err != nil {
-		return fmt.Errorf("error getting git config args: %v", err)
-	}
-	for key, value := range configArgs {
-		err = git(req.TargetDir(), "config", key, value)
+	if !params.SkipDownload {
+		base, err := fetchRevisions(dir, authMan, params, change.Branch,
+			map[string]*gerrit.RevisionInfo{ver.Revision: rev})
 		if err != nil {
-			return err
+			return fmt.Errorf("error fetching change %q: %v", change.ID, err)
+		}
+		if base != "" {
+			req.AddResponseMetadata("checkout base", base)
 		}
 	}
 
-	err = git(dir, "remote", "add", "origin", fetchUrl)
-	if err != nil {
-		return err
-	}
-
-	err = git(dir, "fetch", "origin", fetchRef)
-	if err != nil {
-		return err
-	}
-
-	err = git(dir, "checkout", "FETCH_HEAD")
-	if err != nil {
-		return err
+	if params.VerifySignatures {
+		signer, err := verifier.verify(dir, ver.Revision)
+		if err != nil {
+			return err
+		}
+		req.AddResponseMetadata("commit signer", signer)
 	}
 
-	err = git(dir, "submodule", "update", "--init", "--recursive")
-	if err != nil {
-		return err
+	if !params.SkipDownload {
+		err = checkoutChangeBranch(dir, change.ChangeNumber, rev.PatchSetNumber, change.Branch)
+		if err != nil {
+			return fmt.Errorf("error checking out change branch: %v", err)
+		}
 	}
 
 	// Build response metadata
@@ -169,28 +278,348 @@ func in(req resource.InRequest) error {
 		req.AddResponseMetadata("commit message", rev.Commit.Message)
 	}
 
-	// Write gerrit_version.json
+	footers, err := writeRevisionFiles(dir, src, change, ver.Revision, rev)
+	if err != nil {
+		return err
+	}
+	for _, line := range footers.Lines() {
+		req.AddResponseMetadata("commit footer", line)
+	}
+
+	err = inPatches(c, ctx, dir, change, rev, ver.Revision, params, authMan)
+	if err != nil {
+		return err
+	}
+
+	if params.IncludeComments {
+		err = inComments(req, c, ctx, dir, change)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = inRelatedChanges(req, c, ctx, dir, change, ver.Revision, params)
+	if err != nil {
+		return err
+	}
+
+	err = inDependencies(req, c, ctx, dir, footers, params, authMan)
+	if err != nil {
+		return err
+	}
+
+	return writeGerritVersion(dir, ver, !params.SkipDownload)
+}
+
+// writeRevisionFiles writes the commit message footers of a revision and the
+// Gerrit Trigger variables describing it to the resource directory in dir,
+// returning the footers.
+func writeRevisionFiles(
+	dir string,
+	src Source,
+	change *changeInfo,
+	revision string,
+	rev *gerrit.RevisionInfo,
+) (Footers, error) {
+	var footers Footers
+	if rev.Commit != nil {
+		footers = parseFooters(rev.Commit.Message)
+	}
+	footersPath, err := resourceFilePath(dir, footersFilename)
+	if err == nil {
+		err = footers.WriteToFile(footersPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error writing %s: %v", footersFilename, err)
+	}
+
+	gerritEnvPath, err := resourceFilePath(dir, gerritEnvFilename)
+	if err == nil {
+		err = writeGerritEnv(gerritEnvPath, gerritEnv(src, change, revision, rev))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error writing %s: %v", gerritEnvFilename, err)
+	}
+	return footers, nil
+}
+
+// inGroup fetches each member of a grouped version. Members grouped by topic
+// are checked out into a subdirectory per project; a relation chain is checked
+// out at its tip. The footers and Gerrit Trigger variables of the revision
+// checked out in each directory are written there.
+func inGroup(
+	req resource.InRequest,
+	c gerritService,
+	ctx context.Context,
+	src Source,
+	ver Version,
+	params inParams,
+	authMan *authManager,
+	verifier *signatureVerifier,
+) error {
+	dir := req.TargetDir()
+
+	members, err := ver.groupMembers()
+	if err != nil {
+		return err
+	}
+
+	req.AddResponseMetadata("group", ver.Group)
+
+	var projects []string
+	projectRevs := make(map[string]map[string]*gerrit.RevisionInfo)
+	projectBranches := make(map[string]string)
+	memberChanges := make(map[string]*changeInfo)
+	for _, member := range members {
+		change, rev, err := getVersionChangeRevision(
+			c, ctx, member, "DETAILED_ACCOUNTS", "ALL_COMMITS")
+		if err != nil {
+			return err
+		}
+		memberChanges[member.Revision] = change
+		if projectRevs[change.Project] == nil {
+			projects = append(projects, change.Project)
+			projectRevs[change.Project] = make(map[string]*gerrit.RevisionInfo)
+			projectBranches[change.Project] = change.Branch
+		}
+		projectRevs[change.Project][member.Revision] = rev
+
+		link, err := buildRevisionLink(src, change.ChangeNumber, rev.PatchSetNumber)
+		if err != nil {
+			log.Printf("error building revision link: %v", err)
+			link = change.ID
+		}
+		req.AddResponseMetadata("group member", fmt.Sprintf("%s %s", link, change.Subject))
+	}
+
+	for _, project := range projects {
+		projectDir := dir
+		if src.GroupBy == groupByTopic {
+			projectDir = filepath.Join(dir, project)
+			err = os.MkdirAll(projectDir, 0755)
+			if err != nil {
+				return err
+			}
+		}
+		if !params.SkipDownload {
+			base, err := fetchRevisions(projectDir, authMan, params,
+				projectBranches[project], projectRevs[project])
+			if err != nil {
+				return fmt.Errorf("error fetching project %q: %v", project, err)
+			}
+			if base != "" {
+				req.AddResponseMetadata("checkout base", fmt.Sprintf("%s %s", project, base))
+			}
+			if !params.VerifySignatures {
+				continue
+			}
+			for _, revision := range tipLast(projectRevs[project]) {
+				signer, err := verifier.verify(projectDir, revision)
+				if err != nil {
+					return err
+				}
+				req.AddResponseMetadata("commit signer", fmt.Sprintf("%s %s", revision, signer))
+			}
+		}
+
+		revisions := tipLast(projectRevs[project])
+		tip := revisions[len(revisions)-1]
+		_, err = writeRevisionFiles(
+			projectDir, src, memberChanges[tip], tip, projectRevs[project][tip])
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeGerritVersion(dir, ver, src.GroupBy != groupByTopic && !params.SkipDownload)
+}
+
+// fetchRevisions initializes a git repo in dir, fetches the given revisions
+// and checks out the tip with any revisions that aren't its ancestors merged
+// in, merged or rebased onto branch as requested by params.
+// It returns the branch commit used as a base, if any.
+func fetchRevisions(
+	dir string,
+	authMan *authManager,
+	params inParams,
+	branch string,
+	revs map[string]*gerrit.RevisionInfo,
+) (string, error) {
+	revisions := tipLast(revs)
+	fetchUrl, _, err := resolveFetchUrlRef(params, revs[revisions[0]])
+	if err != nil {
+		return "", fmt.Errorf("could not resolve fetch args: %v", err)
+	}
+
+	// Prepare destination repo and checkout requested revision
+	err = git(dir, "init")
+	if err != nil {
+		return "", err
+	}
+	err = git(dir, "config", "color.ui", "always")
+	if err != nil {
+		return "", err
+	}
+
+	configArgs, err := authMan.gitConfigArgs(fetchUrl)
+	if err != nil {
+		return "", fmt.Errorf("error getting git config args: %v", err)
+	}
+	for key, value := range configArgs {
+		err = git(dir, "config", key, value)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = git(dir, "remote", "add", "origin", fetchUrl)
+	if err != nil {
+		return "", err
+	}
+
+	env, err := authMan.gitEnv()
+	if err != nil {
+		return "", fmt.Errorf("error getting git environment: %v", err)
+	}
+
+	var fetchRefs []string
+	for _, revision := range revisions {
+		_, fetchRef, err := resolveFetchUrlRef(params, revs[revision])
+		if err != nil {
+			return "", fmt.Errorf("could not resolve fetch args: %v", err)
+		}
+		fetchRefs = append(fetchRefs, fetchRef)
+	}
+
+	if params.CacheDir != "" {
+		cacheRefs := fetchRefs
+		if params.Checkout != "" && params.Checkout != checkoutPatchSet {
+			cacheRefs = append(cacheRefs, "refs/heads/"+branch)
+		}
+		cache, err := openObjectCache(params.CacheDir, fetchUrl, configArgs, env, cacheRefs)
+		if err != nil {
+			return "", fmt.Errorf("error updating object cache: %v", err)
+		}
+		defer cache.close()
+		err = cache.borrow(dir)
+		if err != nil {
+			return "", fmt.Errorf("error using object cache: %v", err)
+		}
+	}
+
+	for i, fetchRef := range fetchRefs {
+		fetchArgs := append([]string{"fetch"}, params.fetchArgs()...)
+		err = gitWithEnv(dir, env, append(fetchArgs, "origin", fetchRef)...)
+		if err != nil {
+			return "", err
+		}
+		// Make sure the ref points at the revision, e.g. in case fetch_url is
+		// a stale mirror.
+		fetched, err := gitOutput(dir, nil, "rev-parse", "FETCH_HEAD")
+		if err != nil {
+			return "", err
+		}
+		if fetched != revisions[i] {
+			return "", fmt.Errorf("fetched commit %q from %q, expected revision %q",
+				fetched, fetchRef, revisions[i])
+		}
+	}
+
+	// LFS files are pulled after checking out, with the credentials in the
+	// repo's config.
+	var checkoutEnv []string
+	if params.Lfs.Enabled {
+		checkoutEnv = []string{"GIT_LFS_SKIP_SMUDGE=1"}
+	}
+	err = gitWithEnv(dir, checkoutEnv, "checkout", "FETCH_HEAD")
+	if err != nil {
+		return "", err
+	}
+	err = mergeRevisions(dir, checkoutEnv, revisions)
+	if err != nil {
+		return "", err
+	}
+
+	base, err := checkoutOntoBranch(dir, env, params, branch)
+	if err != nil {
+		return "", err
+	}
+
+	if params.Lfs.Enabled {
+		err = pullLfs(dir, env, params.Lfs)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if params.CacheDir != "" && !params.KeepAlternates {
+		err = dissociate(dir)
+		if err != nil {
+			return "", fmt.Errorf("error dissociating from object cache: %v", err)
+		}
+	}
+
+	submoduleArgs := params.submoduleArgs()
+	if submoduleArgs == nil {
+		return base, nil
+	}
+	return base, gitWithEnv(dir, env, submoduleArgs...)
+}
+
+// writeGerritVersion writes ver to gerrit_version.json in dir. If gitRepo is
+// true, the file is also excluded from the git repo in dir.
+func writeGerritVersion(dir string, ver Version, gitRepo bool) error {
 	gerritVersionPath := filepath.Join(dir, gerritVersionFilename)
-	err = ver.WriteToFile(gerritVersionPath)
+	err := ver.WriteToFile(gerritVersionPath)
 	if err != nil {
 		return fmt.Errorf("error writing %q: %v", gerritVersionPath, err)
 	}
+	if gitRepo {
+		excludeFromGit(dir, gerritVersionFilename)
+	}
+	return nil
+}
+
+// resourceFilePath returns the path of filename in the resource directory of
+// the repo in dir, creating the directory and excluding it from git. Files
+// written there can't clash with the repo's own files.
+func resourceFilePath(dir string, filename string) (string, error) {
+	resourceDir := filepath.Join(dir, resourceDirname)
+	err := os.MkdirAll(resourceDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	excludeFromGit(dir, resourceDirname)
+	return filepath.Join(resourceDir, filename), nil
+}
 
-	// Ignore gerrit_version.json file in repo
+// excludeFromGit adds a file in the root of the git repo in dir to the repo's
+// exclude list, logging any error. Nothing is done if dir isn't a git repo or
+// the file is already excluded.
+func excludeFromGit(dir string, filename string) {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		return
+	}
 	excludePath := filepath.Join(dir, ".git", "info", "exclude")
+	if data, err := ioutil.ReadFile(excludePath); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == "/"+filename {
+				return
+			}
+		}
+	}
 	excludeErr := os.MkdirAll(filepath.Dir(excludePath), 0755)
 	if excludeErr == nil {
-		f, excludeErr := os.OpenFile(excludePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		var f *os.File
+		f, excludeErr = os.OpenFile(excludePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if excludeErr == nil {
 			defer f.Close()
-			_, excludeErr = fmt.Fprintf(f, "\n/%s\n", gerritVersionFilename)
+			_, excludeErr = fmt.Fprintf(f, "\n/%s\n", filename)
 		}
 	}
 	if excludeErr != nil {
-		log.Printf("error adding %q to %q: %v", gerritVersionPath, excludePath, excludeErr)
+		log.Printf("error adding %q to %q: %v", filename, excludePath, excludeErr)
 	}
-
-	return nil
 }
 
 func resolveFetchUrlRef(params inParams, rev *gerrit.RevisionInfo) (url, ref string, err error) {
@@ -218,18 +647,53 @@ func resolveFetchUrlRef(params inParams, rev *gerrit.RevisionInfo) (url, ref str
 }
 
 func git(dir string, args ...string) error {
+	return gitWithEnv(dir, nil, args...)
+}
+
+// gitWithEnv runs git with additional environment variables, e.g. for
+// commands which connect to the remote.
+func gitWithEnv(dir string, env []string, args ...string) error {
+	_, err := gitOutput(dir, env, args...)
+	return err
+}
+
+// gitOutput runs git like gitWithEnv, returning its trimmed output.
+func gitOutput(dir string, env []string, args ...string) (string, error) {
 	gitArgs := append([]string{"-C", dir}, args...)
 	log.Printf("git %v", gitArgs)
-	output, err := execGit(gitArgs...)
+	output, err := execGit(env, gitArgs...)
 	log.Printf("git output:\n%s", output)
 	if err != nil {
 		err = fmt.Errorf("git failed: %v", err)
 	}
-	return err
+	return strings.TrimSpace(string(output)), err
 }
 
-func realExecGit(args ...string) ([]byte, error) {
-	return exec.Command("git", args...).CombinedOutput()
+// realExecGit runs git, returning its stdout. Its stderr, e.g. warnings, is
+// logged, and included in the error if git fails.
+func realExecGit(env []string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("%v: %s", err, stderr.String())
+	} else if stderr.Len() > 0 {
+		log.Printf("git stderr:\n%s", stderr.String())
+	}
+	return output, err
+}
+
+func buildChangeLink(src Source, changeNum int) (string, error) {
+	srcUrl, err := url.Parse(src.Url)
+	if err != nil {
+		return "", err
+	}
+	srcUrl.Path = path.Join(srcUrl.Path, fmt.Sprintf("c/%d", changeNum))
+	return srcUrl.String(), nil
 }
 
 func buildRevisionLink(src Source, changeNum int, psNum int) (string, error) {
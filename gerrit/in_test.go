@@ -15,6 +15,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -55,6 +57,24 @@ func testIn(t *testing.T, src Source, ver Version, params inParams) (Version, []
 	return resp.Version, resp.Metadata
 }
 
+func testInError(t *testing.T, src Source, ver Version, params inParams) error {
+	var err error
+	testInDestDir, err = ioutil.TempDir(testTempDir, "repo")
+	if err != nil {
+		panic(err)
+	}
+
+	src.Url = testGerritUrl
+	req := testRequest{Source: src, Version: ver, Params: params}
+	return resource.TestInFunc(t, req, nil, testInDestDir, in)
+}
+
+// testResourceFile returns the path of a file written to the resource
+// directory of the last repo fetched by testIn.
+func testResourceFile(filename string) string {
+	return filepath.Join(testInDestDir, resourceDirname, filename)
+}
+
 func TestInResponse(t *testing.T) {
 	ver, metadata := testIn(t, Source{}, testInVersion, inParams{})
 	assert.True(t, testInVersion.Equal(ver), "%v != %v", testInVersion, ver)
@@ -167,6 +187,63 @@ func TestInGitUsernamePassword(t *testing.T) {
 	assert.True(t, os.IsNotExist(err), "%s wasn't deleted", credsPath)
 }
 
+func TestInGitToken(t *testing.T) {
+	var headerConfigPath string
+	var headerConfigOutput []byte
+	mockGitWithArg("include.path", func(args []string, idx int) {
+		var err error
+		headerConfigPath = args[idx+1]
+		headerConfigOutput, err = exec.Command(
+			"git", "config", "--file", headerConfigPath, "http.extraHeader").CombinedOutput()
+		assert.NoError(t, err, string(headerConfigOutput))
+	})
+
+	testIn(t, Source{Token: "secret"}, testInVersion, inParams{})
+	assert.Equal(t, "Authorization: Bearer secret\n", string(headerConfigOutput))
+
+	// Header config file should be deleted
+	_, err := os.Stat(headerConfigPath)
+	assert.True(t, os.IsNotExist(err), "%s wasn't deleted", headerConfigPath)
+}
+
+func TestInGitSsh(t *testing.T) {
+	var sshCommand string
+	var keyData []byte
+	var keyMode os.FileMode
+	mockGitWithArg("fetch", func(args []string, idx int) {
+		for _, env := range testGitLastEnv {
+			if strings.HasPrefix(env, "GIT_SSH_COMMAND=") {
+				sshCommand = strings.TrimPrefix(env, "GIT_SSH_COMMAND=")
+			}
+		}
+		// Read the key through the quoted command to check the quoting.
+		keyPath, err := exec.Command("sh", "-c",
+			"set -- "+sshCommand+`; while [ "$1" != -i ]; do shift; done; printf %s "$2"`).Output()
+		assert.NoError(t, err)
+		keyData, err = ioutil.ReadFile(string(keyPath))
+		assert.NoError(t, err)
+		info, err := os.Stat(string(keyPath))
+		assert.NoError(t, err)
+		keyMode = info.Mode()
+	})
+
+	testIn(t, Source{
+		PrivateKey: "-----BEGIN KEY-----\nsecret\n-----END KEY-----",
+		KnownHosts: "gerrit.example.com ssh-ed25519 AAAA",
+	}, testInVersion, inParams{FetchUrl: "ssh://ci@gerrit.example.com:29418/testproject"})
+	assert.Equal(t, "-----BEGIN KEY-----\nsecret\n-----END KEY-----\n", string(keyData))
+	assert.Equal(t, os.FileMode(0600), keyMode)
+	assert.Contains(t, sshCommand, "'StrictHostKeyChecking=yes'")
+	assert.Contains(t, sshCommand, "'UserKnownHostsFile=")
+}
+
+func TestShellQuote(t *testing.T) {
+	arg := `it's "$(quoted)"`
+	output, err := exec.Command("sh", "-c", "printf %s "+shellQuote(arg)).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, arg, string(output))
+}
+
 func TestInGerritVersionFile(t *testing.T) {
 	testIn(t, Source{}, testInVersion, inParams{})
 
@@ -175,3 +252,584 @@ func TestInGerritVersionFile(t *testing.T) {
 	assert.NoError(t, ver.ReadFromFile(versionPath))
 	assert.True(t, testInVersion.Equal(ver), "%v != %v", testInVersion, ver)
 }
+
+func TestInGroupByTopic(t *testing.T) {
+	var fetchDir string
+	mockGitWithArg("fetch", func(args []string, idx int) {
+		fetchDir = args[1]
+	})
+
+	ver := Version{
+		ChangeId: "testproject~testbranch~Itestchange2",
+		Revision: "deadbeef0",
+		Created:  time.Unix(200, 0),
+		Group:    "topic:testtopic",
+		Members:  "testproject~testbranch~Itestchange1 deadbeef0,testproject~testbranch~Itestchange2 deadbeef0",
+	}
+	_, metadata := testIn(t, Source{GroupBy: "topic"}, ver, inParams{})
+	assert.Contains(t, metadata, resource.MetadataField{Name: "group", Value: "topic:testtopic"})
+	assert.Contains(t, metadata, resource.MetadataField{
+		Name:  "group member",
+		Value: fmt.Sprintf("%s/c/2/1 Test Subject", testGerritUrl),
+	})
+	assert.Equal(t, filepath.Join(testInDestDir, testProject), fetchDir)
+
+	var fileVer Version
+	assert.NoError(t, fileVer.ReadFromFile(filepath.Join(testInDestDir, gerritVersionFilename)))
+	assert.True(t, ver.Equal(fileVer), "%v != %v", ver, fileVer)
+}
+
+func TestInGroupResourceFiles(t *testing.T) {
+	testIn(t, Source{GroupBy: "topic"}, Version{
+		ChangeId: "testproject~testbranch~Itestchange2",
+		Revision: "deadbeef0",
+		Group:    "topic:testtopic",
+		Members:  "testproject~testbranch~Itestchange1 deadbeef0,testproject~testbranch~Itestchange2 deadbeef0",
+	}, inParams{SkipDownload: true})
+
+	// The files describe the newest revision of the project.
+	env, err := ioutil.ReadFile(
+		filepath.Join(testInDestDir, testProject, resourceDirname, gerritEnvFilename))
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(env), "GERRIT_CHANGE_NUMBER='2'")
+	}
+	_, err = os.Stat(filepath.Join(testInDestDir, testProject, resourceDirname, footersFilename))
+	assert.NoError(t, err)
+}
+
+func TestInGroupInvalid(t *testing.T) {
+	ver := Version{
+		ChangeId: "testproject~testbranch~Itestchange2",
+		Revision: "deadbeef0",
+		Group:    "topic:testtopic",
+		Members:  "testproject~testbranch~Itestchange1 deadbeef0,testproject~testbranch~Itestchange2 deadbeef0",
+	}
+	for _, params := range []inParams{
+		{IncludeComments: true},
+		{InterdiffPatchSet: 1},
+		{RelatedBranches: true},
+	} {
+		err := testInError(t, Source{GroupBy: "topic"}, ver, params)
+		if assert.Error(t, err, "%+v", params) {
+			assert.Contains(t, err.Error(), "can't be used with group_by", "%+v", params)
+		}
+	}
+}
+
+func TestInGroupSameProject(t *testing.T) {
+	mockGitResult("--independent", "deadbeef0\ndeadbeef1", nil)
+	var merged string
+	mockGitWithArg("merge", func(args []string, idx int) {
+		merged = args[len(args)-1]
+	})
+
+	testIn(t, Source{GroupBy: "topic"}, Version{
+		ChangeId: "testproject~testbranch~Itestchange2",
+		Revision: "deadbeef1",
+		Group:    "topic:testtopic",
+		Members:  "testproject~testbranch~Itestchange1 deadbeef0,testproject~testbranch~Itestchange2 deadbeef1",
+	}, inParams{})
+	// The newest revision is checked out, with the other merged in.
+	assert.Equal(t, "deadbeef0", merged)
+}
+
+func TestInGroupSameProjectConflict(t *testing.T) {
+	mockGitResult("--independent", "deadbeef0\ndeadbeef1", nil)
+	mockGitResult("--no-ff", "", errors.New("conflict"))
+	mockGitResult("--diff-filter=U", "main.go", nil)
+
+	err := testInError(t, Source{GroupBy: "topic"}, Version{
+		ChangeId: "testproject~testbranch~Itestchange2",
+		Revision: "deadbeef1",
+		Group:    "topic:testtopic",
+		Members:  "testproject~testbranch~Itestchange1 deadbeef0,testproject~testbranch~Itestchange2 deadbeef1",
+	}, inParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(),
+			"merging revision deadbeef0 into deadbeef1 failed with conflicts in: main.go")
+	}
+}
+
+func TestInFooters(t *testing.T) {
+	_, metadata := testIn(t, Source{}, Version{
+		ChangeId: "Itestchange2",
+		Revision: "deadbeef0",
+	}, inParams{})
+	assert.Contains(t, metadata, resource.MetadataField{Name: "commit footer", Value: "CI-Pipelines: fast"})
+
+	data, err := ioutil.ReadFile(testResourceFile(footersFilename))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"CI-Pipelines": ["fast"], "Change-Id": ["Itestchange2"]}`, string(data))
+}
+
+func TestInCheckoutMerge(t *testing.T) {
+	mockGitResult("rev-parse", "deadbeef0", nil)
+	mockGitResult("rev-parse", "patchsetcommit", nil)
+	mockGitResult("rev-parse", "basecommit", nil)
+	var branchFetched bool
+	mockGitWithArg("refs/heads/testbranch", func(args []string, idx int) {
+		branchFetched = args[idx-2] == "fetch"
+	})
+	var checkedOut, merged string
+	mockGitWithArg("--detach", func(args []string, idx int) {
+		checkedOut = args[idx+1]
+	})
+	mockGitWithArg("--no-ff", func(args []string, idx int) {
+		merged = args[len(args)-1]
+		assert.Contains(t, testGitLastEnv, "GIT_COMMITTER_NAME=Concourse")
+	})
+
+	_, metadata := testIn(t, Source{}, testInVersion, inParams{Checkout: "merge"})
+	assert.True(t, branchFetched)
+	assert.Equal(t, "basecommit", checkedOut)
+	assert.Equal(t, "patchsetcommit", merged)
+	assert.Contains(t, metadata, resource.MetadataField{Name: "checkout base", Value: "basecommit"})
+}
+
+func TestInCheckoutRebase(t *testing.T) {
+	mockGitResult("rev-parse", "deadbeef0", nil)
+	mockGitResult("rev-parse", "patchsetcommit", nil)
+	mockGitResult("rev-parse", "basecommit", nil)
+	var rebasedOnto string
+	mockGitWithArg("rebase", func(args []string, idx int) {
+		rebasedOnto = args[idx+1]
+	})
+
+	_, metadata := testIn(t, Source{}, testInVersion, inParams{Checkout: "rebase"})
+	assert.Equal(t, "basecommit", rebasedOnto)
+	assert.Contains(t, metadata, resource.MetadataField{Name: "checkout base", Value: "basecommit"})
+}
+
+func TestInCheckoutPatchSet(t *testing.T) {
+	_, metadata := testIn(t, Source{}, testInVersion, inParams{Checkout: "patchset"})
+	for _, field := range metadata {
+		assert.NotEqual(t, "checkout base", field.Name)
+	}
+}
+
+func TestInCheckoutConflict(t *testing.T) {
+	mockGitResult("rev-parse", "deadbeef0", nil)
+	mockGitResult("rev-parse", "patchsetcommit", nil)
+	mockGitResult("rev-parse", "basecommit", nil)
+	mockGitResult("--no-ff", "CONFLICT", errors.New("exit status 1"))
+	mockGitResult("--diff-filter=U", "a.txt\nb.txt\n", nil)
+	var aborted bool
+	mockGitWithArg("--abort", func(args []string, idx int) {
+		aborted = args[idx-1] == "merge"
+	})
+
+	err := testInError(t, Source{}, testInVersion, inParams{Checkout: "merge"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "merge onto testbranch (basecommit) failed with conflicts in: a.txt, b.txt")
+	}
+	assert.True(t, aborted)
+}
+
+func TestInCheckoutInvalid(t *testing.T) {
+	err := testInError(t, Source{}, testInVersion, inParams{Checkout: "squash"})
+	assert.EqualError(t, err, `unsupported checkout "squash"`)
+}
+
+func TestInRelatedChanges(t *testing.T) {
+	// Record every branch created.
+	var branches []string
+	defer func(origExecGit func([]string, ...string) ([]byte, error)) {
+		execGit = origExecGit
+	}(execGit)
+	execGit = func(env []string, args ...string) ([]byte, error) {
+		if args[2] == "branch" {
+			branches = append(branches, strings.Join(args[3:], " "))
+		}
+		return testExecGit(env, args...)
+	}
+
+	_, metadata := testIn(t, Source{}, Version{
+		ChangeId: "Itestchange3",
+		Revision: "deadbeef0",
+	}, inParams{RelatedBranches: true})
+
+	var ancestors []relatedChange
+	data, err := ioutil.ReadFile(testResourceFile(relatedChangesFilename))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &ancestors))
+	if assert.Len(t, ancestors, 2) {
+		assert.Equal(t, 2, ancestors[0].ChangeNumber)
+		assert.Equal(t, "commit2", ancestors[0].Commit)
+		assert.True(t, ancestors[0].Outdated())
+		assert.Equal(t, 1, ancestors[1].ChangeNumber)
+		assert.False(t, ancestors[1].Outdated())
+	}
+	assert.Contains(t, metadata, resource.MetadataField{
+		Name: "related change", Value: "2/1 Test Subject (outdated)"})
+	assert.Contains(t, metadata, resource.MetadataField{
+		Name: "related change", Value: "1/1 Test Subject"})
+	assert.Equal(t, []string{"related/2 commit2", "related/1 commit1"}, branches)
+}
+
+func TestDependsOnChangeId(t *testing.T) {
+	for value, expected := range map[string]string{
+		"Iabc123": "Iabc123",
+		"12345":   "12345",
+		"https://review.example.com/c/project/+/12345":      "12345",
+		"https://review.example.com/c/project/+/12345/7":    "12345",
+		"https://review.example.com/12345":                  "",
+		"https://review.example.com/#/c/12345/":             "12345",
+		"https://review.example.com/c/my/project/+/12345/7": "12345",
+	} {
+		changeId, err := dependsOnChangeId(value)
+		if expected == "" {
+			assert.Error(t, err, value)
+		} else {
+			assert.NoError(t, err, value)
+			assert.Equal(t, expected, changeId, value)
+		}
+	}
+}
+
+func TestInDependsOn(t *testing.T) {
+	// Record fetches by directory.
+	fetches := make(map[string][]string)
+	defer func(origExecGit func([]string, ...string) ([]byte, error)) {
+		execGit = origExecGit
+	}(execGit)
+	execGit = func(env []string, args ...string) ([]byte, error) {
+		if args[2] == "fetch" {
+			fetches[args[1]] = append(fetches[args[1]], args[4])
+		}
+		return testExecGit(env, args...)
+	}
+
+	_, metadata := testIn(t, Source{}, Version{
+		ChangeId: "Itestchange6",
+		Revision: "deadbeef0",
+	}, inParams{FetchUrl: "http://example.com/otherproject"})
+
+	depDir := filepath.Join(testInDestDir, "depends-on", "testproject")
+	assert.Equal(t, []string{"refs/changes/1/6/1"}, fetches[testInDestDir])
+	assert.Equal(t, []string{"refs/changes/1/2/1"}, fetches[depDir])
+
+	var deps []dependency
+	data, err := ioutil.ReadFile(testResourceFile(dependsOnFilename))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &deps))
+	if assert.Len(t, deps, 1) {
+		assert.Equal(t, 2, deps[0].ChangeNumber)
+		assert.Equal(t, "deadbeef0", deps[0].Revision)
+		assert.Equal(t, "NEW", deps[0].Status)
+		assert.Equal(t, filepath.Join("depends-on", "testproject"), deps[0].Path)
+	}
+	assert.Contains(t, metadata, resource.MetadataField{
+		Name: "depends on", Value: "2/1 testproject Test Subject"})
+}
+
+func TestInDependsOnAbandoned(t *testing.T) {
+	err := testInError(t, Source{}, Version{
+		ChangeId: "Itestchange7",
+		Revision: "deadbeef0",
+	}, inParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is abandoned")
+	}
+}
+
+func TestInShallowFetch(t *testing.T) {
+	var fetchArgs []string
+	mockGitWithArg("fetch", func(args []string, idx int) {
+		fetchArgs = args[idx+1:]
+	})
+	var submoduleArgs []string
+	mockGitWithArg("submodule", func(args []string, idx int) {
+		submoduleArgs = args[idx+1:]
+	})
+
+	testIn(t, Source{}, testInVersion, inParams{
+		Depth:      1,
+		Filter:     "blob:none",
+		FetchTags:  true,
+		Submodules: "shallow",
+	})
+	assert.Equal(t, []string{
+		"--depth=1", "--filter=blob:none", "--tags", "origin", "refs/changes/1/1/1",
+	}, fetchArgs)
+	assert.Equal(t, []string{"update", "--init", "--recursive", "--depth=1"}, submoduleArgs)
+}
+
+func TestInDepthInvalid(t *testing.T) {
+	for _, params := range []inParams{
+		{Depth: 1, Checkout: "merge"},
+		{Depth: 1, Checkout: "rebase"},
+		{Depth: 1, RelatedBranches: true},
+	} {
+		err := testInError(t, Source{}, testInVersion, params)
+		if assert.Error(t, err, "%+v", params) {
+			assert.Contains(t, err.Error(), "depth can't be used", "%+v", params)
+		}
+	}
+}
+
+func TestInSubmodules(t *testing.T) {
+	var submoduleArgs []string
+	mockGitWithArg("submodule", func(args []string, idx int) {
+		submoduleArgs = args[idx+1:]
+	})
+	testIn(t, Source{}, testInVersion, inParams{})
+	assert.Equal(t, []string{"update", "--init", "--recursive"}, submoduleArgs)
+
+	submoduleArgs = nil
+	mockGitWithArg("submodule", func(args []string, idx int) {
+		submoduleArgs = args[idx+1:]
+	})
+	testIn(t, Source{}, testInVersion, inParams{SubmodulesTopLevel: true, SubmoduleDepth: 3})
+	assert.Equal(t, []string{"update", "--init", "--depth=3"}, submoduleArgs)
+
+	submoduleArgs = nil
+	mockGitWithArg("submodule", func(args []string, idx int) {
+		submoduleArgs = args[idx+1:]
+	})
+	testIn(t, Source{}, testInVersion, inParams{Submodules: "none"})
+	assert.Nil(t, submoduleArgs)
+	delete(testGitMocks, "submodule")
+
+	err := testInError(t, Source{}, testInVersion, inParams{Submodules: "some"})
+	assert.EqualError(t, err, `unsupported submodules "some"`)
+}
+
+func TestInFiles(t *testing.T) {
+	testIn(t, Source{}, Version{
+		ChangeId: "Itestchange1",
+		Revision: "deadbeef1",
+	}, inParams{})
+
+	data, err := ioutil.ReadFile(testResourceFile(filesFilename))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"path": "logo.png", "status": "A", "lines_inserted": 0, "lines_deleted": 0, "binary": true},
+		{"path": "main.go", "status": "M", "lines_inserted": 3, "lines_deleted": 1},
+		{"path": "new.go", "status": "R", "old_path": "old.go", "lines_inserted": 2, "lines_deleted": 0}
+	]`, string(data))
+
+	data, err = ioutil.ReadFile(testResourceFile(patchFilename))
+	assert.NoError(t, err)
+	assert.Equal(t, "patch for testproject~testbranch~Itestchange1 deadbeef1", string(data))
+
+	_, err = os.Stat(testResourceFile(interdiffFilename))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestInInterdiff(t *testing.T) {
+	// Record every fetch and diff.
+	var calls []string
+	defer func(origExecGit func([]string, ...string) ([]byte, error)) {
+		execGit = origExecGit
+	}(execGit)
+	execGit = func(env []string, args ...string) ([]byte, error) {
+		if args[2] == "fetch" || args[2] == "diff" {
+			calls = append(calls, strings.Join(args[2:], " "))
+		}
+		return testExecGit(env, args...)
+	}
+
+	testIn(t, Source{}, Version{
+		ChangeId: "Itestchange1",
+		Revision: "deadbeef2",
+	}, inParams{InterdiffPatchSet: 1})
+
+	interdiffPath, err := filepath.Abs(testResourceFile(interdiffFilename))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"fetch origin refs/changes/1/1/3",
+		"fetch origin refs/changes/1/1/1",
+		"diff --no-color --output=" + interdiffPath + " deadbeef0 deadbeef2",
+	}, calls)
+}
+
+func TestInInterdiffNoPatchSet(t *testing.T) {
+	err := testInError(t, Source{}, Version{
+		ChangeId: "Itestchange1",
+		Revision: "deadbeef2",
+	}, inParams{InterdiffPatchSet: 4})
+	assert.Error(t, err)
+}
+
+func TestInComments(t *testing.T) {
+	_, metadata := testIn(t, Source{}, Version{
+		ChangeId: "Itestchange2",
+		Revision: "deadbeef0",
+	}, inParams{IncludeComments: true})
+	assert.Contains(t, testGerritLastChangeOptions, "MESSAGES")
+
+	var messages []changeMessage
+	data, err := ioutil.ReadFile(testResourceFile(messagesFilename))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &messages))
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, 1, messages[0].PatchSet)
+		assert.Equal(t, testCIUsername, messages[0].Author.Username)
+	}
+
+	var threads []commentThread
+	data, err = ioutil.ReadFile(testResourceFile(commentsFilename))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &threads))
+	if assert.Len(t, threads, 3) {
+		assert.Equal(t, "main.go", threads[0].Path)
+		assert.Equal(t, 3, threads[0].Line)
+		assert.False(t, threads[0].Unresolved)
+		assert.Len(t, threads[0].Comments, 2)
+
+		assert.Equal(t, 2, threads[1].PatchSet)
+		assert.True(t, threads[1].Unresolved)
+
+		assert.Equal(t, "new.go", threads[2].Path)
+		assert.Equal(t, &commentRange{StartLine: 1, EndLine: 2}, threads[2].Range)
+		assert.True(t, threads[2].Unresolved)
+		if assert.Len(t, threads[2].Comments, 2) {
+			assert.Equal(t, "Broken", threads[2].Comments[0].Message)
+		}
+	}
+	assert.Contains(t, metadata, resource.MetadataField{
+		Name: "unresolved comment threads", Value: "2"})
+}
+
+func TestInWithoutComments(t *testing.T) {
+	testIn(t, Source{}, testInVersion, inParams{})
+	_, err := os.Stat(testResourceFile(messagesFilename))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(testResourceFile(commentsFilename))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestInSkipDownload(t *testing.T) {
+	var gitCalls [][]string
+	defer func(origExecGit func([]string, ...string) ([]byte, error)) {
+		execGit = origExecGit
+	}(execGit)
+	execGit = func(env []string, args ...string) ([]byte, error) {
+		gitCalls = append(gitCalls, args)
+		return testExecGit(env, args...)
+	}
+
+	_, metadata := testIn(t, Source{}, Version{
+		ChangeId: "Itestchange6",
+		Revision: "deadbeef0",
+	}, inParams{SkipDownload: true})
+	assert.Empty(t, gitCalls)
+	assert.Contains(t, metadata, resource.MetadataField{Name: "project", Value: testProject})
+
+	_, err := os.Stat(filepath.Join(testInDestDir, ".git"))
+	assert.True(t, os.IsNotExist(err))
+	for _, path := range []string{
+		testResourceFile(footersFilename),
+		testResourceFile(filesFilename),
+		testResourceFile(patchFilename),
+		testResourceFile(dependsOnFilename),
+	} {
+		_, err = os.Stat(path)
+		assert.NoError(t, err, path)
+	}
+
+	// Dependencies are listed without a path.
+	var deps []dependency
+	data, err := ioutil.ReadFile(testResourceFile(dependsOnFilename))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &deps))
+	if assert.Len(t, deps, 1) {
+		assert.Equal(t, 2, deps[0].ChangeNumber)
+		assert.Empty(t, deps[0].Path)
+	}
+
+	// A put can use the version written by the get.
+	req := testRequest{
+		Source: Source{Url: testGerritUrl},
+		Params: outParams{Repository: filepath.Base(testInDestDir), Message: "hi"},
+	}
+	var resp testResourceResponse
+	assert.NoError(t, resource.TestOutFunc(t, req, &resp, testTempDir, out))
+	assert.Equal(t, "Itestchange6", testGerritLastChangeId)
+	assert.Equal(t, "deadbeef0", testGerritLastRevision)
+}
+
+func TestInSkipDownloadGroup(t *testing.T) {
+	var gitCalls [][]string
+	defer func(origExecGit func([]string, ...string) ([]byte, error)) {
+		execGit = origExecGit
+	}(execGit)
+	execGit = func(env []string, args ...string) ([]byte, error) {
+		gitCalls = append(gitCalls, args)
+		return testExecGit(env, args...)
+	}
+
+	ver := Version{
+		ChangeId: "testproject~testbranch~Itestchange2",
+		Revision: "deadbeef0",
+		Group:    "topic:testtopic",
+		Members:  "testproject~testbranch~Itestchange1 deadbeef0,testproject~testbranch~Itestchange2 deadbeef0",
+	}
+	testIn(t, Source{GroupBy: "topic"}, ver, inParams{SkipDownload: true})
+	assert.Empty(t, gitCalls)
+
+	var fileVer Version
+	assert.NoError(t, fileVer.ReadFromFile(filepath.Join(testInDestDir, gerritVersionFilename)))
+	assert.True(t, ver.Equal(fileVer), "%v != %v", ver, fileVer)
+}
+
+func TestInSkipDownloadInvalid(t *testing.T) {
+	err := testInError(t, Source{}, testInVersion, inParams{
+		SkipDownload: true, RelatedBranches: true})
+	assert.Error(t, err)
+}
+
+func TestInFetchedRevisionMismatch(t *testing.T) {
+	mockGitResult("rev-parse", "badc0ffee", nil)
+	err := testInError(t, Source{}, testInVersion, inParams{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `fetched commit "badc0ffee"`)
+	}
+}
+
+func TestInChangeBranch(t *testing.T) {
+	repo, restore := testRealGitRepo(t, nil)
+	defer restore()
+
+	testIn(t, Source{}, testInVersion, inParams{FetchUrl: repo})
+	for args, expected := range map[string]string{
+		"rev-parse --abbrev-ref HEAD":     "change/1/1",
+		"config branch.change/1/1.remote": "origin",
+		"config branch.change/1/1.merge":  "refs/heads/testbranch",
+	} {
+		output, err := realExecGit(nil, append([]string{"-C", testInDestDir}, strings.Fields(args)...)...)
+		assert.NoError(t, err, string(output))
+		assert.Equal(t, expected, strings.TrimSpace(string(output)), args)
+	}
+}
+
+func TestInGerritEnv(t *testing.T) {
+	testIn(t, Source{}, Version{
+		ChangeId: "Itestchange2",
+		Revision: "deadbeef1",
+	}, inParams{})
+
+	data, err := ioutil.ReadFile(testResourceFile(gerritEnvFilename))
+	assert.NoError(t, err)
+	lines := strings.Split(string(data), "\n")
+	for _, line := range []string{
+		"GERRIT_PROJECT='testproject'",
+		"GERRIT_BRANCH='testbranch'",
+		"GERRIT_CHANGE_NUMBER='2'",
+		"GERRIT_CHANGE_ID='Itestchange2'",
+		"GERRIT_PATCHSET_NUMBER='2'",
+		"GERRIT_PATCHSET_REVISION='deadbeef1'",
+		"GERRIT_REFSPEC='refs/changes/1/2/2'",
+		"GERRIT_CHANGE_URL='" + testGerritUrl + "/c/2'",
+		"GERRIT_PATCHSET_UPLOADER='Testy McTestface <testy@example.com>'",
+	} {
+		assert.Contains(t, lines, line)
+	}
+
+	// The file can be sourced by a shell.
+	output, err := exec.Command("sh", "-c",
+		`. "$1" && echo "$GERRIT_CHANGE_COMMIT_MESSAGE" | base64 -d`,
+		"sh", testResourceFile(gerritEnvFilename)).CombinedOutput()
+	assert.NoError(t, err, string(output))
+	assert.Contains(t, string(output), "CI-Pipelines: fast")
+}
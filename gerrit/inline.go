@@ -0,0 +1,261 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileComment is an inline comment read from the comments_file param of out.
+type fileComment struct {
+	Path       string        `json:"path"`
+	Line       int           `json:"line"`
+	Range      *commentRange `json:"range"`
+	Message    string        `json:"message"`
+	Unresolved bool          `json:"unresolved"`
+
+	// Fix suggestions are only made from the fix_file param of out.
+	FixSuggestions []fixSuggestionInfo `json:"-"`
+}
+
+func (fc fileComment) validate() error {
+	if fc.Path == "" {
+		return fmt.Errorf("path required")
+	}
+	if strings.TrimSpace(fc.Message) == "" {
+		return fmt.Errorf("message required")
+	}
+	if fc.Line < 0 {
+		return fmt.Errorf("line must not be negative")
+	}
+	if r := fc.Range; r != nil {
+		if r.StartLine < 1 || r.EndLine < r.StartLine ||
+			r.StartLine == r.EndLine && r.EndCharacter < r.StartCharacter {
+			return fmt.Errorf("invalid range")
+		}
+		if fc.Line != 0 && fc.Line != r.EndLine {
+			return fmt.Errorf("line must be the range's end_line")
+		}
+	}
+	return nil
+}
+
+// input returns the comment for the file at path in a revision, which its
+// fix suggestions are moved to.
+func (fc fileComment) input(path string) commentInput {
+	var fixes []fixSuggestionInfo
+	for _, fix := range fc.FixSuggestions {
+		var replacements []fixReplacementInfo
+		for _, replacement := range fix.Replacements {
+			replacement.Path = path
+			replacements = append(replacements, replacement)
+		}
+		fix.Replacements = replacements
+		fixes = append(fixes, fix)
+	}
+	return commentInput{
+		Line:           fc.Line,
+		Range:          fc.Range,
+		Message:        fc.Message,
+		Unresolved:     fc.Unresolved,
+		FixSuggestions: fixes,
+	}
+}
+
+// readCommentsFile reads a JSON list of inline comments.
+func readCommentsFile(path string) ([]fileComment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var comments []fileComment
+	err = json.NewDecoder(f).Decode(&comments)
+	if err != nil {
+		return nil, err
+	}
+	for i, comment := range comments {
+		err = comment.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid comment %d: %v", i, err)
+		}
+	}
+	return comments, nil
+}
+
+// assignComments returns the comments on files in each version's revision.
+// Each comment is assigned to a single revision, as chosen by commentRevision.
+// Comments on files that aren't in any of the revisions are returned
+// separately, except for suggested fixes, which are dropped.
+func assignComments(
+	c gerritService,
+	ctx context.Context,
+	vers []Version,
+	comments []fileComment,
+) ([]map[string][]commentInput, map[string][]commentInput, error) {
+	assigned := make([]map[string][]commentInput, len(vers))
+	unassigned := make(map[string][]commentInput)
+	if len(comments) == 0 {
+		return assigned, unassigned, nil
+	}
+
+	var revs []revisionFiles
+	for _, ver := range vers {
+		change, rev, err := getVersionChangeRevision(c, ctx, ver, "ALL_FILES")
+		if err != nil {
+			return nil, nil, err
+		}
+		files := revisionFiles{
+			changeId: ver.ChangeId,
+			project:  change.Project,
+			created:  rev.Created.Time(),
+		}
+		for path := range rev.Files {
+			files.paths = append(files.paths, path)
+		}
+		revs = append(revs, files)
+	}
+
+	for _, comment := range comments {
+		i, path, err := commentRevision(revs, comment.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i >= 0 {
+			if assigned[i] == nil {
+				assigned[i] = make(map[string][]commentInput)
+			}
+			assigned[i][path] = append(assigned[i][path], comment.input(path))
+		} else if len(comment.FixSuggestions) > 0 {
+			// Fixes can't be applied from the message.
+			log.Printf("%q isn't in the patch set; dropping its suggested fix", comment.Path)
+		} else {
+			log.Printf("%q isn't in the patch set; adding its comment to the message", comment.Path)
+			unassigned[comment.Path] = append(unassigned[comment.Path], comment.input(comment.Path))
+		}
+	}
+	return assigned, unassigned, nil
+}
+
+// revisionFiles are the files modified by a revision being reviewed.
+type revisionFiles struct {
+	changeId string
+	project  string
+	created  time.Time
+	paths    []string
+}
+
+// commentRevision returns the index of the revision in revs a comment on path
+// belongs to and the file it refers to, or -1 if no revision modifies the
+// file. A revision with the file at exactly path, or at path relative to its
+// project's directory, is preferred over one whose file path merely ends with.
+// If several revisions of a project match equally well, the newest is used,
+// since it was checked out with the others merged in; matches in several
+// projects are an error.
+func commentRevision(revs []revisionFiles, path string) (int, string, error) {
+	best := -1
+	var bestPath string
+	var bestExact bool
+	var ambiguous []string
+	for i, rev := range revs {
+		file, exact := rev.filePath(path)
+		if file == "" {
+			continue
+		}
+		switch {
+		case best < 0 || exact && !bestExact || exact == bestExact && len(file) > len(bestPath):
+			best, bestPath, bestExact = i, file, exact
+			ambiguous = nil
+		case exact == bestExact && len(file) == len(bestPath):
+			if rev.project != revs[best].project {
+				ambiguous = append(ambiguous, rev.changeId)
+			} else if rev.created.After(revs[best].created) {
+				best, bestPath = i, file
+			}
+		}
+	}
+	if len(ambiguous) > 0 {
+		return -1, "", fmt.Errorf("comment on %q is ambiguous; it matches files in %s",
+			path, strings.Join(append([]string{revs[best].changeId}, ambiguous...), ", "))
+	}
+	return best, bestPath, nil
+}
+
+// filePath returns the file in the revision that path refers to, and whether
+// path names it exactly. Tools often report absolute paths or paths relative
+// to another directory, so the longest file that path ends with is used if
+// none match exactly.
+func (rf revisionFiles) filePath(path string) (string, bool) {
+	var match string
+	for _, file := range rf.paths {
+		if file == path || path == rf.project+"/"+file {
+			return file, true
+		}
+		if matchesFilePath(path, file) && len(file) > len(match) {
+			match = file
+		}
+	}
+	return match, false
+}
+
+// commentSummaryLine formats an inline comment for a review message, like a
+// compiler diagnostic.
+func commentSummaryLine(path string, comment commentInput) string {
+	location := path
+	if r := comment.Range; r != nil {
+		location = fmt.Sprintf("%s:%d-%d", path, r.StartLine, r.EndLine)
+	} else if comment.Line != 0 {
+		location = fmt.Sprintf("%s:%d", path, comment.Line)
+	}
+	return fmt.Sprintf("%s: %s", location, comment.Message)
+}
+
+// appendCommentSummary appends inline comments to a review message, one per
+// line.
+func appendCommentSummary(message string, comments map[string][]commentInput) string {
+	var paths []string
+	for path := range comments {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var lines []string
+	for _, path := range paths {
+		for _, comment := range comments[path] {
+			lines = append(lines, commentSummaryLine(path, comment))
+		}
+	}
+	return appendMessageLines(message, lines)
+}
+
+// appendMessageLines appends lines to a review message as a new paragraph.
+func appendMessageLines(message string, lines []string) string {
+	if len(lines) == 0 {
+		return message
+	}
+	summary := strings.Join(lines, "\n")
+	if message == "" {
+		return summary
+	}
+	return message + "\n\n" + summary
+}
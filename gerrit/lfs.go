@@ -0,0 +1,74 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// lfsParam is the "lfs" in param: either a boolean, or a comma separated list
+// of path patterns to fetch Git LFS files for.
+type lfsParam struct {
+	Enabled bool
+	Include []string
+}
+
+func (lp *lfsParam) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		*lp = lfsParam{Enabled: enabled}
+		return nil
+	}
+	var include string
+	if err := json.Unmarshal(data, &include); err != nil {
+		return fmt.Errorf("lfs must be a boolean or include patterns")
+	}
+	*lp = lfsParam{}
+	for _, pattern := range strings.Split(include, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			lp.Include = append(lp.Include, pattern)
+		}
+	}
+	lp.Enabled = len(lp.Include) > 0
+	return nil
+}
+
+func (lp lfsParam) MarshalJSON() ([]byte, error) {
+	if len(lp.Include) > 0 {
+		return json.Marshal(strings.Join(lp.Include, ","))
+	}
+	return json.Marshal(lp.Enabled)
+}
+
+// pullLfs replaces Git LFS pointer files in the checkout in dir with their
+// contents. Credentials come from the repo's config, like for fetching.
+func pullLfs(dir string, env []string, lfs lfsParam) error {
+	err := git(dir, "lfs", "install", "--local")
+	if err != nil {
+		return fmt.Errorf("error installing git lfs: %v", err)
+	}
+	args := []string{"lfs", "pull"}
+	if len(lfs.Include) > 0 {
+		args = append(args, "--include="+strings.Join(lfs.Include, ","))
+	}
+	err = gitWithEnv(dir, env, args...)
+	if err != nil {
+		return fmt.Errorf("error pulling git lfs files: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLfsParam(t *testing.T) {
+	for data, expected := range map[string]lfsParam{
+		`true`:                     {Enabled: true},
+		`false`:                    {},
+		`"*.bin, assets/**"`:       {Enabled: true, Include: []string{"*.bin", "assets/**"}},
+		`{"lfs": "not a pattern"}`: {},
+	} {
+		var lfs lfsParam
+		err := json.Unmarshal([]byte(data), &lfs)
+		if strings.HasPrefix(data, "{") {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, expected, lfs, data)
+
+		// Params are marshaled back in tests.
+		marshaled, err := json.Marshal(lfs)
+		assert.NoError(t, err)
+		var roundTripped lfsParam
+		assert.NoError(t, json.Unmarshal(marshaled, &roundTripped))
+		assert.Equal(t, lfs, roundTripped)
+	}
+}
+
+func TestInLfs(t *testing.T) {
+	var checkoutEnv []string
+	mockGitWithArg("checkout", func(args []string, idx int) {
+		checkoutEnv = testGitLastEnv
+	})
+	var pullArgs []string
+	mockGitWithArg("pull", func(args []string, idx int) {
+		pullArgs = args[idx-1:]
+	})
+
+	var lfs lfsParam
+	assert.NoError(t, json.Unmarshal([]byte(`"*.bin"`), &lfs))
+	testIn(t, Source{}, testInVersion, inParams{Lfs: lfs})
+	assert.Equal(t, []string{"GIT_LFS_SKIP_SMUDGE=1"}, checkoutEnv)
+	assert.Equal(t, []string{"lfs", "pull", "--include=*.bin"}, pullArgs)
+}
+
+// testLfsHandler stands in for a Git LFS server with the basic transfer
+// adapter, serving the given objects by OID and requiring auth.
+// See: https://github.com/git-lfs/git-lfs/blob/master/docs/api/batch.md
+func testLfsHandler(t *testing.T, objects map[string]string, auth string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != auth {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/objects/batch") {
+			var batch struct {
+				Objects []struct {
+					Oid  string `json:"oid"`
+					Size int64  `json:"size"`
+				} `json:"objects"`
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+			var resp []map[string]interface{}
+			for _, object := range batch.Objects {
+				resp = append(resp, map[string]interface{}{
+					"oid":  object.Oid,
+					"size": object.Size,
+					"actions": map[string]interface{}{
+						"download": map[string]interface{}{
+							"href":   fmt.Sprintf("http://%s/objects/%s", r.Host, object.Oid),
+							"header": map[string]string{"Authorization": auth},
+						},
+					},
+				})
+			}
+			w.Header().Set("Content-Type", "application/vnd.git-lfs+json")
+			assert.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+				"transfer": "basic",
+				"objects":  resp,
+			}))
+			return
+		}
+		oid := strings.TrimPrefix(r.URL.Path, "/objects/")
+		contents, ok := objects[oid]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(contents))
+	}
+}
+
+func TestInLfsServer(t *testing.T) {
+	if err := exec.Command("git", "lfs", "version").Run(); err != nil {
+		t.Skip("git lfs not found")
+	}
+
+	contents := "large file contents"
+	sum := sha256.Sum256([]byte(contents))
+	oid := hex.EncodeToString(sum[:])
+	lfsServer := httptest.NewServer(testLfsHandler(
+		t, map[string]string{oid: contents}, "Bearer secret"))
+	defer lfsServer.Close()
+
+	repo, restore := testRealGitRepo(t, map[string]string{
+		".gitattributes": "*.bin filter=lfs diff=lfs merge=lfs -text\n",
+		".lfsconfig":     fmt.Sprintf("[lfs]\n\turl = %s\n", lfsServer.URL),
+		"large.bin": fmt.Sprintf(
+			"version https://git-lfs.github.com/spec/v1\noid sha256:%s\nsize %d\n",
+			oid, len(contents)),
+	})
+	defer restore()
+
+	testIn(t, Source{Token: "secret"}, testInVersion, inParams{
+		FetchUrl: repo,
+		Lfs:      lfsParam{Enabled: true},
+	})
+	data, err := ioutil.ReadFile(filepath.Join(testInDestDir, "large.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, contents, string(data))
+}
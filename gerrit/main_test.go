@@ -16,8 +16,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -43,6 +45,18 @@ const (
 	testName           = "Testy McTestface"
 	testEmail          = "testy@example.com"
 	testCommitMessage  = "Commit message"
+	testTopic          = "testtopic"
+	testCIUsername     = "ci"
+)
+
+var (
+	// Commit messages by test number; defaults to testCommitMessage.
+	testCommitMessages = map[int]string{
+		2: "Test Subject\n\nBody\n\nCI-Pipelines: fast\nChange-Id: Itestchange2",
+		3: "Test Subject\n\nSkip-CI: true\nChange-Id: Itestchange3",
+		6: "Test Subject\n\nDepends-On: https://review.example.com/c/testproject/+/2",
+		7: "Test Subject\n\nDepends-On: Itestchange5",
+	}
 )
 
 var (
@@ -55,10 +69,26 @@ var (
 	testGerritLastQ             string
 	testGerritLastN             int
 	testGerritLastChangeId      string
+	testGerritLastChangeOptions []string
 	testGerritLastRevision      string
-	testGerritLastReviewInput   *gerrit.ReviewInput
+	testGerritLastReviewInput   *reviewInput
+	testGerritReviewedRevisions []string
+	testGerritLastNotModified   bool
+	testGerritRevokedToken      string
+	testGerritMergeableInQuery  bool
+	testGerritMergeableRequests []string
+
+	// Robot comments posted by the CI account, by change ID and path.
+	testGerritRobotComments = make(map[string]map[string][]commentInfo)
 
-	testGitMocks = make(map[string][]func([]string, int))
+	testTokenRequests  int
+	testTokenExpiresIn int
+
+	testGitMocks   = make(map[string][]func([]string, int))
+	testGitResults = make(map[string][]testGitResult)
+	testGitLastEnv []string
+	// testGitFetchedRef is the last change ref fetched.
+	testGitFetchedRef string
 )
 
 type testRequest struct {
@@ -73,6 +103,10 @@ type testResourceResponse struct {
 }
 
 func TestMain(m *testing.M) {
+	if os.Getenv(testSshServerEnv) != "" {
+		os.Exit(testSshServe(os.Args[1:]))
+	}
+
 	// Run a separate func so defers run before Exit.
 	os.Exit(func() int {
 		var err error
@@ -95,14 +129,16 @@ func TestMain(m *testing.M) {
 				testGerritUrl, localhostIp.String(), "localhost", 1)
 		}
 
-		// Mock out git execution
+		// Mock out git and ssh execution
 		execGit = testExecGit
+		execSsh = testExecSsh
 
 		return m.Run()
 	}())
 }
 
-func testExecGit(args ...string) ([]byte, error) {
+func testExecGit(env []string, args ...string) ([]byte, error) {
+	testGitLastEnv = env
 	for i := 0; i < len(args); i++ {
 		mockFuncs, ok := testGitMocks[args[i]]
 		if ok {
@@ -113,17 +149,89 @@ func testExecGit(args ...string) ([]byte, error) {
 			break
 		}
 	}
+	for i := 0; i < len(args); i++ {
+		results := testGitResults[args[i]]
+		if len(results) > 0 {
+			testGitResults[args[i]] = results[1:]
+			return []byte(results[0].output), results[0].err
+		}
+	}
+	if len(args) > 2 && args[2] == "fetch" {
+		testGitFetchedRef = args[len(args)-1]
+	}
+	if len(args) == 4 && args[2] == "rev-parse" && args[3] == "FETCH_HEAD" {
+		return []byte(testRefRevision(testGitFetchedRef)), nil
+	}
 	return []byte{}, nil
 }
 
+// testRefRevision returns the revision of a test change ref, e.g. "deadbeef1"
+// for "refs/changes/1/1/2". Other refs are taken to be the first revision.
+func testRefRevision(ref string) string {
+	patchSet, err := strconv.Atoi(ref[strings.LastIndex(ref, "/")+1:])
+	if err != nil || patchSet < 1 {
+		patchSet = 1
+	}
+	return fmt.Sprintf("%s%d", testRevisionPrefix, patchSet-1)
+}
+
 func mockGitWithArg(arg string, f func([]string, int)) {
 	testGitMocks[arg] = append(testGitMocks[arg], f)
 }
 
+// mockGitResult makes the next git command with arg return output and err.
+func mockGitResult(arg string, output string, err error) {
+	testGitResults[arg] = append(testGitResults[arg], testGitResult{output, err})
+}
+
+type testGitResult struct {
+	output string
+	err    error
+}
+
+// testCIAccount is the account the tests are authenticated as.
+var testCIAccount = gerrit.AccountInfo{NumericID: 1000, Username: testCIUsername}
+
+// testComments are the inline comments on every test change: one resolved and
+// two unresolved threads. The CI account posted c3.
+var testComments = map[string][]commentInfo{
+	"main.go": {
+		{Id: "c1", PatchSet: 1, Line: 3, Message: "Typo", Unresolved: true,
+			Updated: gerrit.TimeStamp(time.Unix(1000, 0))},
+		{Id: "c2", PatchSet: 1, Line: 3, InReplyTo: "c1", Message: "Done",
+			Updated: gerrit.TimeStamp(time.Unix(2000, 0))},
+		{Id: "c3", PatchSet: 2, Line: 10, Message: "Why?", Unresolved: true,
+			Author: &testCIAccount, Updated: gerrit.TimeStamp(time.Unix(3000, 0))},
+	},
+	"new.go": {
+		{Id: "c5", PatchSet: 1, InReplyTo: "c4", Message: "Still broken", Unresolved: true,
+			Updated: gerrit.TimeStamp(time.Unix(5000, 0))},
+		{Id: "c4", PatchSet: 1, Range: &commentRange{StartLine: 1, EndLine: 2},
+			Message: "Broken", Unresolved: true, Updated: gerrit.TimeStamp(time.Unix(4000, 0))},
+	},
+}
+
+// testFiles are the files modified by every test revision.
+var testFiles = map[string]*gerrit.FileInfo{
+	"/COMMIT_MSG": {Status: "A", LinesInserted: 7},
+	"main.go":     {LinesInserted: 3, LinesDeleted: 1},
+	"new.go":      {Status: "R", OldPath: "old.go", LinesInserted: 2},
+	"logo.png":    {Status: "A", Binary: true},
+}
+
 func testBuildChange(testNumber int, revisionCount int) gerrit.ChangeInfo {
 	changeId := fmt.Sprintf("%s%d", testChangeIdPrefix, testNumber)
+	commitMessage, ok := testCommitMessages[testNumber]
+	if !ok {
+		commitMessage = testCommitMessage
+	}
+	status := "NEW"
+	if testNumber == 5 {
+		status = "ABANDONED"
+	}
 	change := gerrit.ChangeInfo{
 		ID:           fmt.Sprintf("%s~%s~%s", testProject, testBranch, changeId),
+		Status:       status,
 		ChangeNumber: testNumber,
 		Project:      testProject,
 		Branch:       testBranch,
@@ -160,15 +268,68 @@ func testBuildChange(testNumber int, revisionCount int) gerrit.ChangeInfo {
 					Email: testEmail,
 				},
 				Subject: testSubject,
-				Message: testCommitMessage,
+				Message: commitMessage,
 			},
 		}
 		change.CurrentRevision = revision
 		change.Updated = created
 	}
+
+	// The CI account voted on each current revision, except on change 3, where
+	// its vote was copied from the first revision. It also voted on the first
+	// revision of change 2.
+	ciAccount := testCIAccount
+	if revisionCount > 0 {
+		voteDate := change.Revisions[change.CurrentRevision].Created
+		if testNumber == 3 {
+			voteDate = change.Revisions[testRevisionPrefix+"0"].Created
+		}
+		change.Labels = map[string]gerrit.LabelInfo{
+			"Verified": {All: []gerrit.ApprovalInfo{
+				{AccountInfo: ciAccount, Value: 1, Date: voteDate},
+			}},
+		}
+	}
+	switch testNumber {
+	case 1:
+		// The vote on the first revision of change 1 was removed.
+		change.Messages = []gerrit.ChangeMessageInfo{{
+			Author:         &ciAccount,
+			Message:        "Patch Set 1: Verified+1",
+			RevisionNumber: 1,
+		}, {
+			Author:         &ciAccount,
+			Message:        "Removed Verified+1 by CI",
+			RevisionNumber: 1,
+		}}
+	case 2:
+		change.Messages = []gerrit.ChangeMessageInfo{{
+			Author:         &ciAccount,
+			Message:        "Patch Set 1: Verified+1\n\nBuild passed",
+			RevisionNumber: 1,
+		}}
+	}
 	return change
 }
 
+// testRevisionLabels returns the labels of a test change as of one of its
+// revisions, like Gerrit's review of a revision. Besides the votes on current
+// revisions, the CI account voted on the first revision of changes 2 and 3.
+func testRevisionLabels(change gerrit.ChangeInfo, revision string) map[string]gerrit.LabelInfo {
+	if revision == change.CurrentRevision {
+		return change.Labels
+	}
+	rev := change.Revisions[revision]
+	if rev.PatchSetNumber != 1 || change.ChangeNumber != 2 && change.ChangeNumber != 3 {
+		return nil
+	}
+	return map[string]gerrit.LabelInfo{
+		"Verified": {All: []gerrit.ApprovalInfo{
+			{AccountInfo: testCIAccount, Value: 1, Date: rev.Created},
+		}},
+	}
+}
+
 func testGerritWriteResponse(w http.ResponseWriter, v interface{}) {
 	// The gerrit client expects a XSRF-defeating header first
 	_, err := w.Write([]byte(")]}'\n"))
@@ -185,12 +346,15 @@ func testGerritHandler(w http.ResponseWriter, r *http.Request) {
 	testGerritLastRequest = r
 
 	revisionCount := 0
+	withFiles := false
 	for _, o := range r.URL.Query()["o"] {
 		switch o {
 		case "CURRENT_REVISION":
 			revisionCount = 1
 		case "ALL_REVISIONS":
 			revisionCount = 3
+		case "ALL_FILES":
+			withFiles = true
 		}
 	}
 
@@ -198,9 +362,16 @@ func testGerritHandler(w http.ResponseWriter, r *http.Request) {
 
 	testGerritLastAuthenticated = strings.HasPrefix(r.URL.Path, "/a")
 
+	if r.URL.Path == "/token" {
+		testTokenHandler(w, r)
+		return
+	}
+
 	if testGerritLastAuthenticated {
 		authCookie, _ := r.Cookie("auth")
-		if r.Header.Get("Authorization") == "" && authCookie == nil {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" && authCookie == nil ||
+			testGerritRevokedToken != "" && authHeader == "Bearer "+testGerritRevokedToken {
 			w.Header().Add("WWW-Authenticate", `Digest realm="Gerrit", nonce="foobar"`)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
@@ -223,30 +394,125 @@ func testGerritHandler(w http.ResponseWriter, r *http.Request) {
 			n = 3
 		}
 
-		var changes []gerrit.ChangeInfo
+		var changes []changeInfo
 		for i := 0; i < n; i++ {
-			changes = append(changes, testBuildChange(i+1, revisionCount))
+			// Changes can be excluded from results with -change:<number>.
+			if strings.Contains(testGerritLastQ, fmt.Sprintf("-change:%d", i+1)) {
+				continue
+			}
+			change := changeInfo{
+				ChangeInfo: testBuildChange(i+1, revisionCount),
+				Topic:      testTopic,
+			}
+			if testGerritMergeableInQuery {
+				mergeable := i+1 != 2
+				change.Mergeable = &mergeable
+			}
+			changes = append(changes, change)
 		}
 		// Sort changes by update time descending
 		sort.Slice(changes, func(i, j int) bool {
 			return changes[i].Updated.Time().After(changes[j].Updated.Time())
 		})
 		testGerritWriteResponse(w, changes)
+	} else if path == "/accounts/self" {
+		if !testGerritLastAuthenticated {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		testGerritWriteResponse(w, testCIAccount)
+	} else if strings.HasSuffix(path, "/review") && r.Method == "GET" {
+		testNumber, _ := testParseChangeId(pathParts[2])
+		change := testBuildChange(testNumber, 3)
+		change.Labels = testRevisionLabels(change, pathParts[4])
+		testGerritWriteResponse(w, changeInfo{ChangeInfo: change})
 	} else if strings.HasSuffix(path, "/review") {
 		testGerritLastChangeId = pathParts[2]
 		testGerritLastRevision = pathParts[4]
+		testGerritReviewedRevisions = append(testGerritReviewedRevisions,
+			fmt.Sprintf("%s %s", pathParts[2], pathParts[4]))
+		testGerritLastReviewInput = nil
 		err = json.NewDecoder(r.Body).Decode(&testGerritLastReviewInput)
 		if err != nil {
 			panic(err)
 		}
+		for path, comments := range testGerritLastReviewInput.RobotComments {
+			robotComments := testGerritRobotComments[pathParts[2]]
+			if robotComments == nil {
+				robotComments = make(map[string][]commentInfo)
+				testGerritRobotComments[pathParts[2]] = robotComments
+			}
+			for _, comment := range comments {
+				patchSet, _ := strconv.Atoi(strings.TrimPrefix(pathParts[4], testRevisionPrefix))
+				robotComments[path] = append(robotComments[path], commentInfo{
+					PatchSet: patchSet + 1,
+					Line:     comment.Line,
+					Message:  comment.Message,
+					Author:   &testCIAccount,
+				})
+			}
+		}
 		// The gerrit client seems to ignore this response
 		testGerritWriteResponse(w, map[string]string{})
+	} else if strings.HasSuffix(path, "/comments") {
+		testGerritWriteResponse(w, testComments)
+	} else if strings.HasSuffix(path, "/robotcomments") {
+		robotComments := testGerritRobotComments[pathParts[2]]
+		if robotComments == nil {
+			robotComments = map[string][]commentInfo{}
+		}
+		testGerritWriteResponse(w, robotComments)
+	} else if strings.HasSuffix(path, "/patch") {
+		// Patches are base64 encoded, without the XSRF-defeating header.
+		_, err = io.WriteString(w, base64.StdEncoding.EncodeToString(
+			[]byte(fmt.Sprintf("patch for %s %s", pathParts[2], pathParts[4]))))
+	} else if strings.HasSuffix(path, "/mergeable") {
+		// Only change 2 has merge conflicts.
+		testGerritMergeableRequests = append(testGerritMergeableRequests,
+			fmt.Sprintf("%s %s", pathParts[2], pathParts[4]))
+		testNumber, _ := testParseChangeId(pathParts[2])
+		testGerritWriteResponse(w, map[string]bool{"mergeable": testNumber != 2})
+	} else if strings.HasSuffix(path, "/related") {
+		// All test changes are in one relation chain, newest first.
+		var related []relatedChangeInfo
+		for i := 3; i > 0; i-- {
+			related = append(related, relatedChangeInfo{
+				ChangeId: fmt.Sprintf("%s%d", testChangeIdPrefix, i),
+				Commit: gerrit.CommitInfo{
+					CommitID: fmt.Sprintf("commit%d", i),
+					Subject:  testSubject,
+				},
+				ChangeNumber:          i,
+				RevisionNumber:        1,
+				CurrentRevisionNumber: i,
+				Status:                "NEW",
+			})
+		}
+		testGerritWriteResponse(w, map[string]interface{}{"changes": related})
 	} else if strings.HasPrefix(path, "/changes/") {
 		testGerritLastChangeId = pathParts[2]
-		if strings.HasPrefix(testGerritLastChangeId, testChangeIdPrefix) {
-			testNumber, _ := strconv.Atoi(
-				strings.TrimPrefix(testGerritLastChangeId, testChangeIdPrefix))
-			testGerritWriteResponse(w, testBuildChange(testNumber, revisionCount))
+		testGerritLastChangeOptions = r.URL.Query()["o"]
+		testNumber, ok := testParseChangeId(testGerritLastChangeId)
+		if ok {
+			change := changeInfo{
+				ChangeInfo: testBuildChange(testNumber, revisionCount),
+				Topic:      testTopic,
+			}
+			if withFiles {
+				for revision, info := range change.Revisions {
+					info.Files = testFiles
+					change.Revisions[revision] = info
+				}
+			}
+			// Support conditional requests
+			etag := fmt.Sprintf(`"%s-%d"`, r.URL.RequestURI(), change.Updated.Time().Unix())
+			testGerritLastNotModified = r.Header.Get("If-None-Match") == etag
+			if testGerritLastNotModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			testGerritWriteResponse(w, change)
 		} else {
 			w.WriteHeader(http.StatusNotFound)
 		}
@@ -258,6 +524,41 @@ func testGerritHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// testTokenHandler stands in for an OAuth2 token endpoint, issuing tokens
+// "testtoken1", "testtoken2", etc. to client "testclient".
+func testTokenHandler(w http.ResponseWriter, r *http.Request) {
+	clientId, clientSecret, _ := r.BasicAuth()
+	if r.Method != "POST" || r.FormValue("grant_type") != "client_credentials" ||
+		clientId != "testclient" || clientSecret != "testsecret" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	testTokenRequests++
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": fmt.Sprintf("testtoken%d", testTokenRequests),
+		"token_type":   "Bearer",
+		"expires_in":   testTokenExpiresIn,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// testParseChangeId returns the test number of a change ID in any of the
+// forms Gerrit accepts.
+func testParseChangeId(changeId string) (int, bool) {
+	changeId = changeId[strings.LastIndex(changeId, "~")+1:]
+	if testNumber, err := strconv.Atoi(changeId); err == nil {
+		return testNumber, true
+	}
+	if strings.HasPrefix(changeId, testChangeIdPrefix) {
+		testNumber, err := strconv.Atoi(strings.TrimPrefix(changeId, testChangeIdPrefix))
+		return testNumber, err == nil
+	}
+	return 0, false
+}
+
 func testJsonReader(v interface{}) *json.Decoder {
 	data, err := json.Marshal(v)
 	if err != nil {
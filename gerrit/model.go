@@ -31,18 +31,92 @@ type Source struct {
 	Username   string `json:"username"`
 	Password   string `json:"password"`
 	DigestAuth bool   `json:"digest_auth"`
+
+	// OAuth2 bearer token, or client credentials to request one from TokenUrl.
+	Token        string `json:"token"`
+	TokenUrl     string `json:"token_url"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+
+	// PEM encoded CA certificates, and client certificate and key.
+	CaCerts    string `json:"ca_certs"`
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+	Proxy      string `json:"proxy"`
+	NoProxy    string `json:"no_proxy"`
+
+	SshUrl     string `json:"ssh_url"`
+	PrivateKey string `json:"private_key"`
+	KnownHosts string `json:"known_hosts"`
+	GroupBy    string `json:"group_by"`
+
+	SkipIfVoted          SkipIfVoted `json:"skip_if_voted"`
+	RequireMergeable     bool        `json:"require_mergeable"`
+	MergeConflictMessage string      `json:"merge_conflict_message"`
+
+	// Include and exclude revisions by commit message footers; see Footers.
+	IncludeFooters map[string]string `json:"include_footers"`
+	ExcludeFooters map[string]string `json:"exclude_footers"`
+
+	// ASCII armored GPG public keys and SSH allowed signers (see ssh-keygen)
+	// trusted to sign commits, for the verify_signatures param of in.
+	SigningKeys    string `json:"signing_keys"`
+	AllowedSigners string `json:"allowed_signers"`
+}
+
+// SkipIfVoted configures check to skip revisions that an account (usually the
+// CI account) has already voted on.
+type SkipIfVoted struct {
+	Label string `json:"label"`
+	// Account is a username, email address or numeric account ID.
+	Account string `json:"account"`
+	// If CopiedVotes is true, votes copied to a patch set (e.g. through a
+	// trivial rebase) also count.
+	CopiedVotes bool `json:"copied_votes"`
 }
 
 type Version struct {
 	ChangeId string    `json:"change_id"`
 	Revision string    `json:"revision"`
 	Created  time.Time `json:"created"`
+
+	// Informational fields which may be missing from older versions. Concourse
+	// versions may only contain strings, so numbers are encoded as strings.
+	ChangeNumber int    `json:"change_number,omitempty,string"`
+	PatchSet     int    `json:"patch_set,omitempty,string"`
+	Project      string `json:"project,omitempty"`
+	Branch       string `json:"branch,omitempty"`
+
+	// Group and Members are only set for versions grouped by source group_by.
+	// ChangeId, Revision and Created then refer to the newest member revision.
+	Group   string `json:"group,omitempty"`
+	Members string `json:"members,omitempty"`
+}
+
+// newVersion returns the version of a change revision.
+func newVersion(change *changeInfo, revision string) Version {
+	rev := change.Revisions[revision]
+	return Version{
+		ChangeId:     change.ID,
+		Revision:     revision,
+		Created:      rev.Created.Time(),
+		ChangeNumber: change.ChangeNumber,
+		PatchSet:     rev.PatchSetNumber,
+		Project:      change.Project,
+		Branch:       change.Branch,
+	}
 }
 
 func (v Version) Equal(o Version) bool {
 	return v.ChangeId == o.ChangeId &&
 		v.Revision == o.Revision &&
-		v.Created.Equal(o.Created)
+		v.Created.Equal(o.Created) &&
+		v.ChangeNumber == o.ChangeNumber &&
+		v.PatchSet == o.PatchSet &&
+		v.Project == o.Project &&
+		v.Branch == o.Branch &&
+		v.Group == o.Group &&
+		v.Members == o.Members
 }
 
 func (v Version) WriteToFile(path string) error {
@@ -24,8 +24,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"golang.org/x/build/gerrit"
-
 	"github.com/google/concourse-resources/internal/resource"
 )
 
@@ -34,8 +32,34 @@ type outParams struct {
 	Message     string         `json:"message"`
 	MessageFile string         `json:"message_file"`
 	Labels      map[string]int `json:"labels"`
+
+	// A JSON list of inline comments; see fileComment.
+	CommentsFile string `json:"comments_file"`
+
+	// Globs of findings files to post as inline comments; see readFindings.
+	Findings         []string `json:"findings"`
+	FindingsSeverity string   `json:"findings_severity"`
+	MaxComments      int      `json:"max_comments"`
+
+	// Comments are posted as robot comments if RobotId is set.
+	RobotId    string `json:"robot_id"`
+	RobotRunId string `json:"robot_run_id"`
+	RobotUrl   string `json:"robot_url"`
+
+	// A unified diff to suggest as fixes; requires RobotId.
+	FixFile string `json:"fix_file"`
+
+	// What to do if a revision isn't the current one of its change: one of the
+	// onStale* constants. Revisions aren't checked if unset.
+	OnStale string `json:"on_stale"`
 }
 
+const (
+	onStaleSkip = "skip"
+	onStalePost = "post"
+	onStaleFail = "fail"
+)
+
 func init() {
 	resource.RegisterOutFunc(out)
 }
@@ -48,6 +72,24 @@ func out(req resource.OutRequest) error {
 		return err
 	}
 
+	if params.FindingsSeverity != "" {
+		err = validateSeverity(params.FindingsSeverity)
+		if err != nil {
+			return fmt.Errorf("invalid findings_severity: %v", err)
+		}
+	}
+	if params.MaxComments < 0 {
+		return errors.New("max_comments must not be negative")
+	}
+	if params.FixFile != "" && params.RobotId == "" {
+		return errors.New("fix_file requires robot_id")
+	}
+	switch params.OnStale {
+	case "", onStaleSkip, onStalePost, onStaleFail:
+	default:
+		return fmt.Errorf("invalid on_stale %q; must be skip, post or fail", params.OnStale)
+	}
+
 	authMan := newAuthManager(src)
 	defer authMan.cleanup()
 
@@ -82,18 +124,38 @@ func out(req resource.OutRequest) error {
 		}
 	}
 
-	// Replace environment variables in message
-	var variableTokens = map[string]string{
-		"${BUILD_ID}":            os.Getenv("BUILD_ID"),
-		"${BUILD_NAME}":          os.Getenv("BUILD_NAME"),
-		"${BUILD_JOB_NAME}":      os.Getenv("BUILD_JOB_NAME"),
-		"${BUILD_PIPELINE_NAME}": os.Getenv("BUILD_PIPELINE_NAME"),
-		"${BUILD_TEAM_NAME}":     os.Getenv("BUILD_TEAM_NAME"),
-		"${ATC_EXTERNAL_URL}":    os.Getenv("ATC_EXTERNAL_URL"),
+	message = expandBuildVariables(message)
+
+	var comments []fileComment
+	if params.CommentsFile != "" {
+		commentsPath := filepath.Join(req.TargetDir(), params.CommentsFile)
+		comments, err = readCommentsFile(commentsPath)
+		if err != nil {
+			return fmt.Errorf("error reading %q: %v", commentsPath, err)
+		}
+	}
+	if params.FixFile != "" {
+		fixPath := filepath.Join(req.TargetDir(), params.FixFile)
+		fixComments, err := readFixFile(fixPath)
+		if err != nil {
+			return fmt.Errorf("error reading %q: %v", fixPath, err)
+		}
+		comments = append(comments, fixComments...)
 	}
 
-	for k, v := range variableTokens {
-		message = strings.Replace(message, k, v, -1)
+	var robotRunId, robotUrl string
+	if params.RobotId != "" {
+		robotRunId = expandBuildVariables(params.RobotRunId)
+		if robotRunId == "" {
+			robotRunId = os.Getenv("BUILD_ID")
+		}
+		if robotRunId == "" {
+			return errors.New("robot_id requires robot_run_id outside of a build")
+		}
+		robotUrl = expandBuildVariables(params.RobotUrl)
+		if robotUrl == "" {
+			robotUrl = buildUrl()
+		}
 	}
 
 	// Send review
@@ -104,13 +166,100 @@ func out(req resource.OutRequest) error {
 
 	ctx := context.Background()
 
-	err = c.SetReview(ctx, ver.ChangeId, ver.Revision, gerrit.ReviewInput{
-		Message: message,
-		Labels:  params.Labels,
-	})
+	// Grouped versions are reviewed on every member revision.
+	reviewVersions := []Version{ver}
+	if ver.Members != "" {
+		reviewVersions, err = ver.groupMembers()
+		if err != nil {
+			return err
+		}
+	}
+
+	findingComments, findingSummary, err := outFindings(
+		c, ctx, req.TargetDir(), reviewVersions, params)
 	if err != nil {
-		return fmt.Errorf("error sending review: %v", err)
+		return err
+	}
+	comments = append(comments, findingComments...)
+	message = appendMessageLines(message, findingSummary)
+
+	// Comments on files that aren't in the patch set go in the message.
+	inlineComments, otherComments, err := assignComments(c, ctx, reviewVersions, comments)
+	if err != nil {
+		return err
+	}
+	message = appendCommentSummary(message, otherComments)
+
+	// Check for newer patch sets before posting anything.
+	staleNotes := make([]string, len(reviewVersions))
+	if params.OnStale != "" {
+		for i, reviewVer := range reviewVersions {
+			staleNotes[i], err = staleNote(c, ctx, reviewVer)
+			if err != nil {
+				return err
+			}
+			if staleNotes[i] != "" && params.OnStale == onStaleFail {
+				return fmt.Errorf("%q: %s", reviewVer.ChangeId, staleNotes[i])
+			}
+		}
+	}
+
+	for i, reviewVer := range reviewVersions {
+		reviewMessage := message
+		if staleNotes[i] != "" {
+			if params.OnStale == onStaleSkip {
+				log.Printf("not reviewing %q: %s", reviewVer.ChangeId, staleNotes[i])
+				continue
+			}
+			reviewMessage = appendMessageLines(staleNotes[i], []string{message})
+		}
+		review := reviewInput{
+			Message:  reviewMessage,
+			Labels:   params.Labels,
+			Comments: inlineComments[i],
+		}
+		if params.RobotId != "" {
+			review.RobotComments = robotComments(
+				review.Comments, params.RobotId, robotRunId, robotUrl)
+			review.Comments = nil
+		}
+		err = c.setReview(ctx, reviewVer.ChangeId, reviewVer.Revision, review)
+		if err != nil {
+			return fmt.Errorf("error sending review to %q: %v", reviewVer.ChangeId, err)
+		}
 	}
 
 	return nil
 }
+
+// staleNote returns a note saying ver's revision is outdated if it isn't the
+// current revision of its change, or "" if it is.
+func staleNote(c gerritService, ctx context.Context, ver Version) (string, error) {
+	change, rev, err := getVersionChangeRevision(c, ctx, ver)
+	if err != nil {
+		return "", err
+	}
+	if change.CurrentRevision == ver.Revision {
+		return "", nil
+	}
+	current := change.Revisions[change.CurrentRevision]
+	return fmt.Sprintf("Results for outdated patch set %d; the current patch set is %d.",
+		rev.PatchSetNumber, current.PatchSetNumber), nil
+}
+
+// expandBuildVariables replaces Concourse build metadata variables in s.
+func expandBuildVariables(s string) string {
+	var variableTokens = map[string]string{
+		"${BUILD_ID}":            os.Getenv("BUILD_ID"),
+		"${BUILD_NAME}":          os.Getenv("BUILD_NAME"),
+		"${BUILD_JOB_NAME}":      os.Getenv("BUILD_JOB_NAME"),
+		"${BUILD_PIPELINE_NAME}": os.Getenv("BUILD_PIPELINE_NAME"),
+		"${BUILD_TEAM_NAME}":     os.Getenv("BUILD_TEAM_NAME"),
+		"${ATC_EXTERNAL_URL}":    os.Getenv("ATC_EXTERNAL_URL"),
+	}
+
+	for k, v := range variableTokens {
+		s = strings.Replace(s, k, v, -1)
+	}
+	return s
+}
@@ -19,6 +19,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -33,14 +34,26 @@ var (
 )
 
 func testOut(t *testing.T, src Source, params outParams) Version {
-	src.Url = testGerritUrl
+	var resp testResourceResponse
+	assert.NoError(t, testOutWithVersion(t, src, testOutVersion, params, &resp))
+	return resp.Version
+}
 
+// testOutWithVersion runs out on a repository fetched at ver, decoding its
+// response into resp unless it's nil.
+func testOutWithVersion(
+	t *testing.T,
+	src Source,
+	ver Version,
+	params outParams,
+	resp interface{},
+) error {
 	repoDir, err := ioutil.TempDir(testTempDir, "repo")
 	if err != nil {
 		panic(err)
 	}
 
-	err = testOutVersion.WriteToFile(filepath.Join(repoDir, gerritVersionFilename))
+	err = ver.WriteToFile(filepath.Join(repoDir, gerritVersionFilename))
 	if err != nil {
 		panic(err)
 	}
@@ -48,9 +61,7 @@ func testOut(t *testing.T, src Source, params outParams) Version {
 
 	src.Url = testGerritUrl
 	req := testRequest{Source: src, Params: params}
-	var resp testResourceResponse
-	assert.NoError(t, resource.TestOutFunc(t, req, &resp, testTempDir, out))
-	return resp.Version
+	return resource.TestOutFunc(t, req, resp, testTempDir, out)
 }
 
 func TestOutVersion(t *testing.T) {
@@ -176,3 +187,187 @@ func TestOutLabels(t *testing.T) {
 	assert.Equal(t, 1, testGerritLastReviewInput.Labels["Code-Review"])
 	assert.Equal(t, -1, testGerritLastReviewInput.Labels["Verified"])
 }
+
+func TestOutGroup(t *testing.T) {
+	testOutVersion = Version{
+		ChangeId: "change2",
+		Revision: "rev2",
+		Group:    "topic:outtopic",
+		Members:  "change1 rev1,change2 rev2",
+	}
+	defer func() {
+		testOutVersion = Version{ChangeId: "outChange", Revision: "outRev"}
+	}()
+	testGerritReviewedRevisions = nil
+
+	testOut(t, Source{GroupBy: "topic"}, outParams{Message: "group msg"})
+	assert.Equal(t, []string{"change1 rev1", "change2 rev2"}, testGerritReviewedRevisions)
+	assert.Equal(t, "group msg", testGerritLastReviewInput.Message)
+}
+
+// testOutComments runs out on test change 1 with the given comments file.
+func testOutComments(t *testing.T, src Source, comments string, params outParams) error {
+	return testOutCommentsWithVersion(t, src,
+		Version{ChangeId: "Itestchange1", Revision: "deadbeef0"}, comments, params)
+}
+
+func testOutCommentsWithVersion(
+	t *testing.T, src Source, ver Version, comments string, params outParams,
+) error {
+	err := ioutil.WriteFile(filepath.Join(testTempDir, "comments.json"), []byte(comments), 0600)
+	assert.NoError(t, err)
+	params.CommentsFile = "comments.json"
+
+	return testOutWithVersion(t, src, ver, params, nil)
+}
+
+func TestOutCommentsFile(t *testing.T) {
+	err := testOutComments(t, Source{}, `[
+		{"path": "main.go", "line": 3, "message": "Typo", "unresolved": true},
+		{"path": "new.go", "range": {"start_line": 1, "end_line": 2, "end_character": 5}, "message": "Rename"},
+		{"path": "/COMMIT_MSG", "line": 1, "message": "Too long"},
+		{"path": "gone.go", "line": 7, "message": "Not here"}
+	]`, outParams{Message: "Lint"})
+	assert.NoError(t, err)
+
+	review := testGerritLastReviewInput
+	assert.Equal(t, "Lint\n\ngone.go:7: Not here", review.Message)
+	assert.Equal(t, map[string][]commentInput{
+		"main.go": {{Line: 3, Message: "Typo", Unresolved: true}},
+		"new.go": {{Range: &commentRange{StartLine: 1, EndLine: 2, EndCharacter: 5},
+			Message: "Rename"}},
+		"/COMMIT_MSG": {{Line: 1, Message: "Too long"}},
+	}, review.Comments)
+}
+
+func TestOutCommentsFileInvalid(t *testing.T) {
+	for _, comments := range []string{
+		`{"path": "main.go"}`,
+		`[{"path": "main.go", "line": 3}]`,
+		`[{"line": 3, "message": "No path"}]`,
+		`[{"path": "main.go", "line": -1, "message": "Bad line"}]`,
+		`[{"path": "main.go", "range": {"start_line": 3, "end_line": 2}, "message": "Bad range"}]`,
+	} {
+		err := testOutComments(t, Source{}, comments, outParams{})
+		assert.Error(t, err, comments)
+	}
+}
+
+func TestOutGroupCommentsFile(t *testing.T) {
+	err := testOutCommentsWithVersion(t, Source{GroupBy: "topic"}, Version{
+		ChangeId: "Itestchange1",
+		Revision: "deadbeef0",
+		Group:    "topic:outtopic",
+		Members:  "Itestchange2 deadbeef2,Itestchange1 deadbeef0",
+	}, `[{"path": "main.go", "line": 3, "message": "Typo"}]`, outParams{})
+	assert.NoError(t, err)
+	// Both revisions modify main.go; the comment is only posted on the newest,
+	// which is reviewed first.
+	assert.Equal(t, "Itestchange1", testGerritLastChangeId)
+	assert.Empty(t, testGerritLastReviewInput.Comments)
+}
+
+func TestCommentRevision(t *testing.T) {
+	revs := []revisionFiles{
+		{changeId: "a1", project: "a", created: time.Unix(100, 0), paths: []string{"main.go", "lib/util.go"}},
+		{changeId: "a2", project: "a", created: time.Unix(200, 0), paths: []string{"main.go"}},
+		{changeId: "b1", project: "b", created: time.Unix(300, 0), paths: []string{"util.go", "README.md"}},
+		{changeId: "c1", project: "c", created: time.Unix(400, 0), paths: []string{"README.md"}},
+	}
+	for _, tc := range []struct {
+		path     string
+		revision int
+		file     string
+	}{
+		// The newest revision of a project is preferred.
+		{"main.go", 1, "main.go"},
+		{"/src/a/main.go", 1, "main.go"},
+		// Exact matches are preferred, also relative to the project directory.
+		{"util.go", 2, "util.go"},
+		{"a/lib/util.go", 0, "lib/util.go"},
+		{"b/README.md", 2, "README.md"},
+		{"gone.go", -1, ""},
+	} {
+		revision, file, err := commentRevision(revs, tc.path)
+		if assert.NoError(t, err, tc.path) {
+			assert.Equal(t, tc.revision, revision, tc.path)
+			assert.Equal(t, tc.file, file, tc.path)
+		}
+	}
+
+	// Equal matches in different projects are ambiguous.
+	_, _, err := commentRevision(revs, "README.md")
+	assert.Error(t, err)
+}
+
+// testOutStale runs out on a group of the current revision of test change 2 and
+// a stale revision of test change 1, reviewed in that order.
+func testOutStale(t *testing.T, params outParams) error {
+	testGerritReviewedRevisions = nil
+	return testOutWithVersion(t, Source{GroupBy: "topic"}, Version{
+		ChangeId: "Itestchange2",
+		Revision: "deadbeef2",
+		Group:    "topic:outtopic",
+		Members:  "Itestchange2 deadbeef2,Itestchange1 deadbeef0",
+	}, params, nil)
+}
+
+func TestOutStalePost(t *testing.T) {
+	err := testOutStale(t, outParams{Message: "Build passed", OnStale: "post"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Itestchange2 deadbeef2", "Itestchange1 deadbeef0"},
+		testGerritReviewedRevisions)
+	assert.Equal(t, "Results for outdated patch set 1; the current patch set is 3.\n\nBuild passed",
+		testGerritLastReviewInput.Message)
+}
+
+func TestOutStaleSkip(t *testing.T) {
+	err := testOutStale(t, outParams{Message: "Build passed", OnStale: "skip"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Itestchange2 deadbeef2"}, testGerritReviewedRevisions)
+	assert.Equal(t, "Build passed", testGerritLastReviewInput.Message)
+}
+
+func TestOutStaleFail(t *testing.T) {
+	err := testOutStale(t, outParams{Message: "Build passed", OnStale: "fail"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "outdated patch set 1; the current patch set is 3")
+	}
+	assert.Empty(t, testGerritReviewedRevisions)
+}
+
+func TestOutStaleChange(t *testing.T) {
+	// The current patch set of test change 1 is 3.
+	staleVer := Version{ChangeId: "Itestchange1", Revision: "deadbeef0"}
+
+	testGerritReviewedRevisions = nil
+	err := testOutWithVersion(t, Source{}, staleVer,
+		outParams{Message: "Build passed", OnStale: "post"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Itestchange1 deadbeef0"}, testGerritReviewedRevisions)
+	assert.Equal(t, "Results for outdated patch set 1; the current patch set is 3.\n\nBuild passed",
+		testGerritLastReviewInput.Message)
+
+	testGerritReviewedRevisions = nil
+	err = testOutWithVersion(t, Source{}, staleVer,
+		outParams{Message: "Build passed", OnStale: "skip"}, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, testGerritReviewedRevisions)
+
+	err = testOutWithVersion(t, Source{}, staleVer,
+		outParams{Message: "Build passed", OnStale: "fail"}, nil)
+	assert.Error(t, err)
+	assert.Empty(t, testGerritReviewedRevisions)
+
+	// The current revision isn't stale.
+	err = testOutWithVersion(t, Source{},
+		Version{ChangeId: "Itestchange1", Revision: "deadbeef2"},
+		outParams{Message: "Build passed", OnStale: "fail"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "Build passed", testGerritLastReviewInput.Message)
+}
+
+func TestOutStaleInvalid(t *testing.T) {
+	err := testOutStale(t, outParams{OnStale: "ignore"})
+	assert.Error(t, err)
+}
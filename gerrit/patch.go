@@ -0,0 +1,172 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/build/gerrit"
+)
+
+const (
+	filesFilename     = "files.json"
+	patchFilename     = "change.patch"
+	interdiffFilename = "interdiff.patch"
+)
+
+// changedFile is a file modified by a revision, as written to files.json.
+type changedFile struct {
+	Path          string `json:"path"`
+	Status        string `json:"status"`
+	OldPath       string `json:"old_path,omitempty"`
+	LinesInserted int    `json:"lines_inserted"`
+	LinesDeleted  int    `json:"lines_deleted"`
+	Binary        bool   `json:"binary,omitempty"`
+}
+
+// changedFiles returns the files modified by rev, sorted by path. Gerrit's
+// magic files like "/COMMIT_MSG" are left out.
+func changedFiles(rev *gerrit.RevisionInfo) []changedFile {
+	files := []changedFile{}
+	for path, info := range rev.Files {
+		if strings.HasPrefix(path, "/") {
+			continue
+		}
+		file := changedFile{Path: path, Status: "M"}
+		if info != nil {
+			if info.Status != "" {
+				file.Status = info.Status
+			}
+			file.OldPath = info.OldPath
+			file.LinesInserted = info.LinesInserted
+			file.LinesDeleted = info.LinesDeleted
+			file.Binary = info.Binary
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// inPatches writes files.json and change.patch for a change revision to the
+// resource directory of dir, and interdiff.patch if params.InterdiffPatchSet is
+// set.
+func inPatches(
+	c gerritService,
+	ctx context.Context,
+	dir string,
+	change *changeInfo,
+	rev *gerrit.RevisionInfo,
+	revision string,
+	params inParams,
+	authMan *authManager,
+) error {
+	filesPath, err := resourceFilePath(dir, filesFilename)
+	if err == nil {
+		err = writeChangedFiles(filesPath, changedFiles(rev))
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", filesFilename, err)
+	}
+
+	patch, err := c.getPatch(ctx, change.ID, revision)
+	if err == errUnsupportedOverSsh {
+		log.Printf("not writing %s: %v", patchFilename, err)
+	} else if err != nil {
+		return fmt.Errorf("error getting patch: %v", err)
+	} else {
+		patchPath, err := resourceFilePath(dir, patchFilename)
+		if err == nil {
+			err = ioutil.WriteFile(patchPath, patch, 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing %s: %v", patchFilename, err)
+		}
+	}
+
+	if params.InterdiffPatchSet == 0 {
+		return nil
+	}
+	return writeInterdiff(dir, change, revision, params, authMan)
+}
+
+// writeInterdiff fetches patch set params.InterdiffPatchSet of change and
+// writes its diff to revision to interdiff.patch in the resource directory of
+// dir.
+func writeInterdiff(
+	dir string,
+	change *changeInfo,
+	revision string,
+	params inParams,
+	authMan *authManager,
+) error {
+	var oldRevision string
+	var oldRev *gerrit.RevisionInfo
+	for r, info := range change.Revisions {
+		if info.PatchSetNumber == params.InterdiffPatchSet {
+			info := info
+			oldRevision, oldRev = r, &info
+			break
+		}
+	}
+	if oldRev == nil {
+		return fmt.Errorf("no patch set %d on change %q",
+			params.InterdiffPatchSet, change.ID)
+	}
+
+	_, fetchRef, err := resolveFetchUrlRef(params, oldRev)
+	if err != nil {
+		return fmt.Errorf("could not resolve fetch args: %v", err)
+	}
+	env, err := authMan.gitEnv()
+	if err != nil {
+		return fmt.Errorf("error getting git environment: %v", err)
+	}
+	fetchArgs := append([]string{"fetch"}, params.fetchArgs()...)
+	err = gitWithEnv(dir, env, append(fetchArgs, "origin", fetchRef)...)
+	if err != nil {
+		return fmt.Errorf("error fetching patch set %d: %v", params.InterdiffPatchSet, err)
+	}
+
+	interdiffPath, err := resourceFilePath(dir, interdiffFilename)
+	if err == nil {
+		interdiffPath, err = filepath.Abs(interdiffPath)
+	}
+	if err != nil {
+		return err
+	}
+	err = git(dir, "diff", "--no-color", "--output="+interdiffPath, oldRevision, revision)
+	if err != nil {
+		return fmt.Errorf("error writing %q: %v", interdiffPath, err)
+	}
+	return nil
+}
+
+func writeChangedFiles(path string, files []changedFile) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(files)
+}
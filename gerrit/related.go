@@ -0,0 +1,146 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+const (
+	relatedChangesFilename = "related_changes.json"
+)
+
+// relatedChange is an ancestor of a revision in its relation chain, as
+// written to related_changes.json.
+type relatedChange struct {
+	ChangeId        string `json:"change_id"`
+	ChangeNumber    int    `json:"change_number"`
+	PatchSet        int    `json:"patch_set"`
+	CurrentPatchSet int    `json:"current_patch_set"`
+	Commit          string `json:"commit"`
+	Subject         string `json:"subject"`
+	Status          string `json:"status"`
+}
+
+// Outdated reports whether the ancestor patch set has been replaced by a newer
+// one, which the revision isn't based on.
+func (rc relatedChange) Outdated() bool {
+	return rc.CurrentPatchSet != 0 && rc.PatchSet != rc.CurrentPatchSet
+}
+
+// ancestorChanges returns the ancestors of a change revision in its relation
+// chain, nearest first.
+func ancestorChanges(
+	c gerritService,
+	ctx context.Context,
+	change *changeInfo,
+	revision string,
+) ([]relatedChange, error) {
+	related, err := c.getRelatedChanges(ctx, change.ID, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	// Related changes are ordered from descendants to ancestors, including
+	// the change itself.
+	ancestors := []relatedChange{}
+	foundSelf := false
+	for _, info := range related {
+		if info.ChangeNumber == change.ChangeNumber {
+			foundSelf = true
+			continue
+		}
+		if !foundSelf {
+			continue
+		}
+		ancestors = append(ancestors, relatedChange{
+			ChangeId:        info.ChangeId,
+			ChangeNumber:    info.ChangeNumber,
+			PatchSet:        info.RevisionNumber,
+			CurrentPatchSet: info.CurrentRevisionNumber,
+			Commit:          info.Commit.CommitID,
+			Subject:         info.Commit.Subject,
+			Status:          info.Status,
+		})
+	}
+	return ancestors, nil
+}
+
+// inRelatedChanges writes the ancestors of a revision to related_changes.json
+// in the resource directory of dir and adds them to the response metadata, optionally creating a local
+// branch for each.
+func inRelatedChanges(
+	req resource.InRequest,
+	c gerritService,
+	ctx context.Context,
+	dir string,
+	change *changeInfo,
+	revision string,
+	params inParams,
+) error {
+	ancestors, err := ancestorChanges(c, ctx, change, revision)
+	if err == errUnsupportedOverSsh {
+		log.Printf("not writing %s: %v", relatedChangesFilename, err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting related changes: %v", err)
+	}
+
+	for _, ancestor := range ancestors {
+		value := fmt.Sprintf("%d/%d %s",
+			ancestor.ChangeNumber, ancestor.PatchSet, ancestor.Subject)
+		if ancestor.Outdated() {
+			value += " (outdated)"
+		}
+		req.AddResponseMetadata("related change", value)
+
+		if params.RelatedBranches {
+			err = git(dir, "branch", relatedBranchName(ancestor), ancestor.Commit)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	relatedPath, err := resourceFilePath(dir, relatedChangesFilename)
+	if err == nil {
+		err = writeRelatedChanges(relatedPath, ancestors)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %v", relatedChangesFilename, err)
+	}
+	return nil
+}
+
+// relatedBranchName returns the name of the local branch created for an
+// ancestor change.
+func relatedBranchName(rc relatedChange) string {
+	return fmt.Sprintf("related/%d", rc.ChangeNumber)
+}
+
+func writeRelatedChanges(path string, ancestors []relatedChange) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(ancestors)
+}
@@ -0,0 +1,230 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	fixMessage = "Suggested fix"
+)
+
+var (
+	hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+)
+
+// buildUrl returns the URL of the running Concourse build, if known.
+func buildUrl() string {
+	atcUrl := os.Getenv("ATC_EXTERNAL_URL")
+	if atcUrl == "" {
+		return ""
+	}
+	pipeline, job := os.Getenv("BUILD_PIPELINE_NAME"), os.Getenv("BUILD_JOB_NAME")
+	if pipeline == "" || job == "" {
+		return fmt.Sprintf("%s/builds/%s", atcUrl, os.Getenv("BUILD_ID"))
+	}
+	return fmt.Sprintf("%s/teams/%s/pipelines/%s/jobs/%s/builds/%s",
+		atcUrl, os.Getenv("BUILD_TEAM_NAME"), pipeline, job, os.Getenv("BUILD_NAME"))
+}
+
+// robotComments returns comments as robot comments from a robot run.
+func robotComments(
+	comments map[string][]commentInput,
+	robotId string,
+	runId string,
+	url string,
+) map[string][]robotCommentInput {
+	if len(comments) == 0 {
+		return nil
+	}
+	robotComments := make(map[string][]robotCommentInput)
+	for path, pathComments := range comments {
+		for _, comment := range pathComments {
+			robotComments[path] = append(robotComments[path], robotCommentInput{
+				commentInput: comment,
+				RobotId:      robotId,
+				RobotRunId:   runId,
+				Url:          url,
+			})
+		}
+	}
+	return robotComments
+}
+
+// diffHunk is a hunk of a unified diff.
+type diffHunk struct {
+	oldStart int
+	// Lines starting with ' ', '-' or '+'.
+	lines []string
+	// Whether the last added line has no newline at the end of the file.
+	noNewline bool
+}
+
+// fixComment returns a comment on the lines of path changed by the hunk,
+// suggesting the hunk as a fix. Unchanged lines at either end of the hunk are
+// left out of the fix.
+func (h diffHunk) fixComment(path string) fileComment {
+	first, last := 0, len(h.lines)
+	for first < last && h.lines[first][0] == ' ' {
+		first++
+	}
+	for last > first && h.lines[last-1][0] == ' ' {
+		last--
+	}
+
+	start := h.oldStart + first
+	oldCount := 0
+	var replacement []string
+	for _, line := range h.lines[first:last] {
+		if line[0] != '+' {
+			oldCount++
+		}
+		if line[0] != '-' {
+			replacement = append(replacement, line[1:]+"\n")
+		}
+	}
+	if h.noNewline && len(replacement) > 0 && last == len(h.lines) {
+		i := len(replacement) - 1
+		replacement[i] = strings.TrimSuffix(replacement[i], "\n")
+	}
+
+	// Comment on the changed lines, or the line before an insertion.
+	line := start
+	if oldCount == 0 && start > 1 {
+		line = start - 1
+	}
+	return fileComment{
+		Path:    path,
+		Line:    line,
+		Message: fixMessage,
+		FixSuggestions: []fixSuggestionInfo{{
+			Description: fixMessage,
+			Replacements: []fixReplacementInfo{{
+				Path:        path,
+				Range:       commentRange{StartLine: start, EndLine: start + oldCount},
+				Replacement: strings.Join(replacement, ""),
+			}},
+		}},
+	}
+}
+
+// diffPath returns the path of a "---" or "+++" line of a unified diff without
+// git's "a/" or "b/" prefix, or "" for /dev/null.
+func diffPath(line string) string {
+	path := line[4:]
+	if i := strings.IndexByte(path, '\t'); i >= 0 {
+		path = path[:i]
+	}
+	if path == "/dev/null" {
+		return ""
+	}
+	if strings.HasPrefix(path, "a/") || strings.HasPrefix(path, "b/") {
+		path = path[2:]
+	}
+	return path
+}
+
+// readFixFile reads a unified diff, returning a comment suggesting each hunk as
+// a fix. Hunks adding new files are skipped, as fixes can only change existing
+// files.
+func readFixFile(path string) ([]fileComment, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var comments []fileComment
+	var oldPath, newPath string
+	var hunk *diffHunk
+	var oldRemaining, newRemaining int
+	endHunk := func() {
+		if hunk == nil {
+			return
+		}
+		if oldPath == "" {
+			log.Printf("can't suggest a fix adding %q; skipping", newPath)
+		} else {
+			comments = append(comments, hunk.fixComment(oldPath))
+		}
+		hunk = nil
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, `\`) {
+			// "\ No newline at end of file"
+			if hunk != nil && len(hunk.lines) > 0 && hunk.lines[len(hunk.lines)-1][0] == '+' {
+				hunk.noNewline = true
+			}
+			continue
+		}
+		if hunk != nil && (oldRemaining > 0 || newRemaining > 0) {
+			if line == "" {
+				// Some tools trim the space off empty unchanged lines.
+				line = " "
+			}
+			switch line[0] {
+			case ' ':
+				oldRemaining--
+				newRemaining--
+			case '-':
+				oldRemaining--
+			case '+':
+				newRemaining--
+			default:
+				return nil, fmt.Errorf("line %d: unexpected line in hunk: %q", i+1, line)
+			}
+			hunk.lines = append(hunk.lines, line)
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "--- "):
+			endHunk()
+			oldPath = diffPath(line)
+		case strings.HasPrefix(line, "+++ "):
+			newPath = diffPath(line)
+		case strings.HasPrefix(line, "@@ "):
+			endHunk()
+			match := hunkHeaderPattern.FindStringSubmatch(line)
+			if match == nil {
+				return nil, fmt.Errorf("line %d: invalid hunk header %q", i+1, line)
+			}
+			hunk = &diffHunk{}
+			hunk.oldStart, _ = strconv.Atoi(match[1])
+			oldRemaining, newRemaining = 1, 1
+			if match[2] != "" {
+				oldRemaining, _ = strconv.Atoi(match[2])
+			}
+			if match[4] != "" {
+				newRemaining, _ = strconv.Atoi(match[4])
+			}
+			if oldRemaining == 0 {
+				// Insertions start after oldStart.
+				hunk.oldStart++
+			}
+		default:
+			endHunk()
+		}
+	}
+	endHunk()
+	return comments, nil
+}
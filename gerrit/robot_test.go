@@ -0,0 +1,165 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testFixDiff = `diff --git a/main.go b/main.go
+index 1111111..2222222 100644
+--- a/main.go
++++ b/main.go
+@@ -2,4 +2,4 @@ package main
+
+-import "fmt"
++import "os"
+
+ func main() {
+@@ -10,2 +10,3 @@ func main() {
+ 	foo()
++	bar()
+ }
+diff --git a/new.go b/new.go
+--- a/new.go
++++ b/new.go
+@@ -1,2 +0,0 @@
+-package main
+-// old
+diff --git a/added.go b/added.go
+new file mode 100644
+--- /dev/null
++++ b/added.go
+@@ -0,0 +1 @@
++package main
+diff --git a/notes.txt b/notes.txt
+--- a/notes.txt
++++ b/notes.txt
+@@ -1 +1 @@
+-a
+\ No newline at end of file
++b
+\ No newline at end of file
+`
+
+func testFixComment(path string, line int, start int, end int, replacement string) fileComment {
+	return fileComment{
+		Path:    path,
+		Line:    line,
+		Message: "Suggested fix",
+		FixSuggestions: []fixSuggestionInfo{{
+			Description: "Suggested fix",
+			Replacements: []fixReplacementInfo{{
+				Path:        path,
+				Range:       commentRange{StartLine: start, EndLine: end},
+				Replacement: replacement,
+			}},
+		}},
+	}
+}
+
+func TestReadFixFile(t *testing.T) {
+	path := filepath.Join(testTempDir, "fix.diff")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(testFixDiff), 0600))
+
+	comments, err := readFixFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []fileComment{
+		testFixComment("main.go", 3, 3, 4, "import \"os\"\n"),
+		testFixComment("main.go", 10, 11, 11, "\tbar()\n"),
+		testFixComment("new.go", 1, 1, 3, ""),
+		testFixComment("notes.txt", 1, 1, 2, "b"),
+	}, comments)
+}
+
+func TestReadFixFileInvalid(t *testing.T) {
+	for _, diff := range []string{
+		"--- a/main.go\n+++ b/main.go\n@@ -1 +1 @@ main\n-a\n*b\n",
+		"--- a/main.go\n+++ b/main.go\n@@ -x +1 @@\n",
+	} {
+		path := filepath.Join(testTempDir, "invalid.diff")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(diff), 0600))
+		_, err := readFixFile(path)
+		assert.Error(t, err, diff)
+	}
+}
+
+func TestOutRobotComments(t *testing.T) {
+	path := filepath.Join(testTempDir, "robot-fix.diff")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(
+		"--- a/main.go\n+++ b/main.go\n@@ -3 +3 @@\n-import \"fmt\"\n+import \"os\"\n"+
+			"--- a/gone.go\n+++ b/gone.go\n@@ -1 +1 @@\n-a\n+b\n"), 0600))
+	os.Setenv("BUILD_ID", "42")
+	os.Setenv("ATC_EXTERNAL_URL", "https://ci.example.com")
+	os.Setenv("BUILD_TEAM_NAME", "main")
+	os.Setenv("BUILD_PIPELINE_NAME", "lint")
+	os.Setenv("BUILD_JOB_NAME", "gofmt")
+	os.Setenv("BUILD_NAME", "7")
+
+	err := testOutComments(t, Source{}, `[{"path": "new.go", "line": 1, "message": "Rename"}]`,
+		outParams{RobotId: "gofmt", FixFile: "robot-fix.diff"})
+	assert.NoError(t, err)
+
+	review := testGerritLastReviewInput
+	assert.Empty(t, review.Comments)
+	// The fix for gone.go, which isn't in the patch set, is dropped.
+	assert.Empty(t, review.Message)
+	assert.Equal(t, map[string][]robotCommentInput{
+		"main.go": {{
+			commentInput: commentInput{
+				Line:    3,
+				Message: "Suggested fix",
+				FixSuggestions: []fixSuggestionInfo{{
+					Description: "Suggested fix",
+					Replacements: []fixReplacementInfo{{
+						Path:        "main.go",
+						Range:       commentRange{StartLine: 3, EndLine: 4},
+						Replacement: "import \"os\"\n",
+					}},
+				}},
+			},
+			RobotId:    "gofmt",
+			RobotRunId: "42",
+			Url:        "https://ci.example.com/teams/main/pipelines/lint/jobs/gofmt/builds/7",
+		}},
+		"new.go": {{
+			commentInput: commentInput{Line: 1, Message: "Rename"},
+			RobotId:      "gofmt",
+			RobotRunId:   "42",
+			Url:          "https://ci.example.com/teams/main/pipelines/lint/jobs/gofmt/builds/7",
+		}},
+	}, review.RobotComments)
+}
+
+func TestOutRobotRunId(t *testing.T) {
+	os.Setenv("BUILD_NAME", "7")
+	err := testOutComments(t, Source{}, `[{"path": "new.go", "line": 1, "message": "Rename"}]`,
+		outParams{RobotId: "gofmt", RobotRunId: "run-${BUILD_NAME}", RobotUrl: "https://example.com"})
+	assert.NoError(t, err)
+
+	comment := testGerritLastReviewInput.RobotComments["new.go"][0]
+	assert.Equal(t, "run-7", comment.RobotRunId)
+	assert.Equal(t, "https://example.com", comment.Url)
+}
+
+func TestOutFixFileWithoutRobotId(t *testing.T) {
+	err := testOutComments(t, Source{}, `[]`, outParams{FixFile: "robot-fix.diff"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// signatureStatuses describes the signature statuses given by git's "%G?"
+	// format other than "G" (good).
+	// See: https://git-scm.com/docs/pretty-formats
+	signatureStatuses = map[string]string{
+		"B": "bad signature",
+		"U": "good signature with unknown validity",
+		"X": "good signature that has expired",
+		"Y": "good signature made by an expired key",
+		"R": "good signature made by a revoked key",
+		"E": "signature from a key not in the keyring",
+		"N": "no signature",
+	}
+
+	// For testing
+	execGpg = realExecGpg
+)
+
+// signatureVerifier verifies commit signatures against the GPG keys and SSH
+// allowed signers given in the source, and no others.
+type signatureVerifier struct {
+	signingKeys    string
+	allowedSigners string
+
+	gnupgHome_          string
+	allowedSignersPath_ string
+}
+
+func newSignatureVerifier(source Source) *signatureVerifier {
+	return &signatureVerifier{
+		signingKeys:    source.SigningKeys,
+		allowedSigners: source.AllowedSigners,
+	}
+}
+
+// gnupgHome returns a GnuPG home directory with only the signing keys in its
+// keyring, all of which are trusted.
+func (sv *signatureVerifier) gnupgHome() (string, error) {
+	if sv.gnupgHome_ != "" {
+		return sv.gnupgHome_, nil
+	}
+	home, err := ioutil.TempDir(authTempDir, "concourse-gerrit-gnupg")
+	if err != nil {
+		return "", err
+	}
+	sv.gnupgHome_ = home
+
+	err = ioutil.WriteFile(filepath.Join(home, "gpg.conf"), []byte("trust-model always\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	if sv.signingKeys != "" {
+		keysPath := filepath.Join(home, "signing_keys.asc")
+		err = ioutil.WriteFile(keysPath, []byte(sv.signingKeys), 0600)
+		if err != nil {
+			return "", err
+		}
+		output, err := execGpg("--homedir", home, "--batch", "--import", keysPath)
+		if err != nil {
+			return "", fmt.Errorf("error importing signing_keys: %v: %s", err, output)
+		}
+	}
+	return home, nil
+}
+
+func (sv *signatureVerifier) allowedSignersPath() (string, error) {
+	if sv.allowedSigners == "" {
+		return "", nil
+	}
+	var err error
+	if sv.allowedSignersPath_ == "" {
+		sv.allowedSignersPath_, err = writeAuthTempFile(
+			"concourse-gerrit-allowed-signers", sv.allowedSigners)
+	}
+	return sv.allowedSignersPath_, err
+}
+
+// verify returns the signer of revision in the git repo in dir, or an error if
+// it isn't signed by an allowed key.
+func (sv *signatureVerifier) verify(dir string, revision string) (string, error) {
+	home, err := sv.gnupgHome()
+	if err != nil {
+		return "", err
+	}
+	args := []string{}
+	allowedSignersPath, err := sv.allowedSignersPath()
+	if err != nil {
+		return "", err
+	}
+	if allowedSignersPath != "" {
+		args = append(args, "-c", "gpg.ssh.allowedSignersFile="+allowedSignersPath)
+	}
+	args = append(args, "log", "-1", "--format=%G?%n%GS%n%GK", revision)
+	output, err := gitOutput(dir, []string{"GNUPGHOME=" + home}, args...)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.SplitN(output, "\n", 3)
+	for len(lines) < 3 {
+		lines = append(lines, "")
+	}
+	status, signer, key := lines[0], lines[1], lines[2]
+	if status != "G" {
+		description, ok := signatureStatuses[status]
+		if !ok {
+			description = fmt.Sprintf("signature status %q", status)
+		}
+		return "", fmt.Errorf("revision %q is not signed by an allowed key: %s", revision, description)
+	}
+	return fmt.Sprintf("%s (%s)", signer, key), nil
+}
+
+func (sv *signatureVerifier) cleanup() {
+	if sv.gnupgHome_ != "" {
+		err := os.RemoveAll(sv.gnupgHome_)
+		if err != nil {
+			log.Printf("error removing gnupg home %q: %s", sv.gnupgHome_, err)
+		}
+		sv.gnupgHome_ = ""
+	}
+	if sv.allowedSignersPath_ != "" {
+		err := os.Remove(sv.allowedSignersPath_)
+		if err != nil {
+			log.Printf("error removing allowed signers file: %s", err)
+		}
+		sv.allowedSignersPath_ = ""
+	}
+}
+
+func realExecGpg(args ...string) ([]byte, error) {
+	return exec.Command("gpg", args...).CombinedOutput()
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+func TestInVerifySignatures(t *testing.T) {
+	var imported string
+	defer func(origExecGpg func(...string) ([]byte, error)) {
+		execGpg = origExecGpg
+	}(execGpg)
+	execGpg = func(args ...string) ([]byte, error) {
+		data, err := ioutil.ReadFile(args[len(args)-1])
+		imported = string(data)
+		return nil, err
+	}
+	mockGitResult("--format=%G?%n%GS%n%GK", "G\nTesty <testy@example.com>\nABCD1234", nil)
+	var logArgs []string
+	var logEnv []string
+	mockGitWithArg("--format=%G?%n%GS%n%GK", func(args []string, idx int) {
+		logArgs = args
+		logEnv = testGitLastEnv
+	})
+
+	_, metadata := testIn(t, Source{
+		SigningKeys:    "gpg keys",
+		AllowedSigners: "ssh signers",
+	}, testInVersion, inParams{VerifySignatures: true})
+	assert.Equal(t, "gpg keys", imported)
+	assert.Contains(t, metadata, resource.MetadataField{
+		Name: "commit signer", Value: "Testy <testy@example.com> (ABCD1234)"})
+
+	assert.Equal(t, testInVersion.Revision, logArgs[len(logArgs)-1])
+	if assert.Len(t, logEnv, 1) {
+		assert.True(t, strings.HasPrefix(logEnv[0], "GNUPGHOME="))
+	}
+	assert.True(t, strings.HasPrefix(logArgs[3], "gpg.ssh.allowedSignersFile="))
+}
+
+func TestInVerifySignaturesUnsigned(t *testing.T) {
+	mockGitResult("--format=%G?%n%GS%n%GK", "N\n\n", nil)
+	err := testInError(t, Source{AllowedSigners: "ssh signers"}, testInVersion,
+		inParams{VerifySignatures: true})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is not signed by an allowed key: no signature")
+	}
+}
+
+func TestInVerifySignaturesNoKeys(t *testing.T) {
+	err := testInError(t, Source{}, testInVersion, inParams{VerifySignatures: true})
+	assert.Error(t, err)
+}
+
+// testSignedCommit creates a git repo with a commit signed with the given
+// git config, returning the repo and commit.
+func testSignedCommit(t *testing.T, env []string, config ...string) (string, string) {
+	repo, err := ioutil.TempDir(testTempDir, "signed")
+	assert.NoError(t, err)
+	commitArgs := []string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}
+	for _, c := range config {
+		commitArgs = append(commitArgs, "-c", c)
+	}
+	commitArgs = append(commitArgs, "commit", "-S", "--allow-empty", "-m", "Signed")
+	for _, args := range [][]string{{"init"}, commitArgs} {
+		output, err := realExecGit(env, append([]string{"-C", repo}, args...)...)
+		assert.NoError(t, err, string(output))
+	}
+	commit, err := realExecGit(nil, "-C", repo, "rev-parse", "HEAD")
+	assert.NoError(t, err)
+	return repo, strings.TrimSpace(string(commit))
+}
+
+func testSshKey(t *testing.T, name string) (string, string) {
+	keyPath := filepath.Join(testTempDir, name)
+	output, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "",
+		"-C", name, "-f", keyPath).CombinedOutput()
+	assert.NoError(t, err, string(output))
+	pub, err := ioutil.ReadFile(keyPath + ".pub")
+	assert.NoError(t, err)
+	return keyPath, strings.TrimSpace(string(pub))
+}
+
+func TestSignatureVerifierSsh(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	keyPath, pub := testSshKey(t, "signing-key")
+	_, otherPub := testSshKey(t, "other-key")
+	repo, commit := testSignedCommit(t, nil, "gpg.format=ssh", "user.signingKey="+keyPath)
+	origExecGit := execGit
+	execGit = realExecGit
+	defer func() { execGit = origExecGit }()
+
+	verifier := newSignatureVerifier(Source{AllowedSigners: "test@example.com " + pub})
+	defer verifier.cleanup()
+	signer, err := verifier.verify(repo, commit)
+	assert.NoError(t, err)
+	assert.Contains(t, signer, "test@example.com")
+
+	verifier = newSignatureVerifier(Source{AllowedSigners: "test@example.com " + otherPub})
+	defer verifier.cleanup()
+	_, err = verifier.verify(repo, commit)
+	assert.Error(t, err)
+}
+
+func TestSignatureVerifierGpg(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not found")
+	}
+	home, err := ioutil.TempDir(testTempDir, "gnupg")
+	assert.NoError(t, err)
+	defer exec.Command("gpgconf", "--homedir", home, "--kill", "all").Run()
+	output, err := realExecGpg("--homedir", home, "--batch", "--passphrase", "",
+		"--quick-gen-key", "Test <test@example.com>", "ed25519", "sign", "never")
+	if !assert.NoError(t, err, string(output)) {
+		return
+	}
+	keys, err := realExecGpg("--homedir", home, "--armor", "--export", "test@example.com")
+	assert.NoError(t, err, string(keys))
+	repo, commit := testSignedCommit(t, []string{"GNUPGHOME=" + home},
+		"user.signingKey=test@example.com")
+	origExecGit := execGit
+	execGit = realExecGit
+	defer func() { execGit = origExecGit }()
+
+	verifier := newSignatureVerifier(Source{SigningKeys: string(keys)})
+	defer verifier.cleanup()
+	signer, err := verifier.verify(repo, commit)
+	assert.NoError(t, err)
+	assert.Contains(t, signer, "Test <test@example.com>")
+
+	// Only keys in signing_keys are trusted.
+	verifier = newSignatureVerifier(Source{AllowedSigners: "unused"})
+	defer verifier.cleanup()
+	_, err = verifier.verify(repo, commit)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not in the keyring")
+	}
+}
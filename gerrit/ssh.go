@@ -0,0 +1,537 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/build/gerrit"
+)
+
+var (
+	errUnsupportedOverSsh = errors.New("not supported over ssh")
+
+	patchSetMessagePattern = regexp.MustCompile(`^Patch Set (\d+):`)
+
+	// For testing
+	execSsh = realExecSsh
+)
+
+// gerritSsh implements gerritService with Gerrit's SSH commands.
+// See: https://gerrit-review.googlesource.com/Documentation/cmd-index.html
+type gerritSsh struct {
+	url     *url.URL
+	authMan *authManager
+}
+
+// See: https://gerrit-review.googlesource.com/Documentation/json.html
+type sshChange struct {
+	Project       string        `json:"project"`
+	Branch        string        `json:"branch"`
+	Topic         string        `json:"topic"`
+	Id            string        `json:"id"`
+	Number        int           `json:"number"`
+	Subject       string        `json:"subject"`
+	Owner         sshAccount    `json:"owner"`
+	CommitMessage string        `json:"commitMessage"`
+	CreatedOn     int64         `json:"createdOn"`
+	LastUpdated   int64         `json:"lastUpdated"`
+	Status        string        `json:"status"`
+	PatchSets     []sshPatchSet `json:"patchSets"`
+	CurrentPatch  *sshPatchSet  `json:"currentPatchSet"`
+	Comments      []sshComment  `json:"comments"`
+}
+
+type sshPatchSet struct {
+	Number    int           `json:"number"`
+	Revision  string        `json:"revision"`
+	Parents   []string      `json:"parents"`
+	Ref       string        `json:"ref"`
+	Uploader  sshAccount    `json:"uploader"`
+	Author    sshAccount    `json:"author"`
+	CreatedOn int64         `json:"createdOn"`
+	Approvals []sshApproval `json:"approvals"`
+	Files     []sshFile     `json:"files"`
+}
+
+type sshFile struct {
+	File       string `json:"file"`
+	FileOld    string `json:"fileOld"`
+	Type       string `json:"type"`
+	Insertions int    `json:"insertions"`
+	Deletions  int    `json:"deletions"`
+}
+
+type sshApproval struct {
+	Type      string     `json:"type"`
+	Value     string     `json:"value"`
+	GrantedOn int64      `json:"grantedOn"`
+	By        sshAccount `json:"by"`
+}
+
+type sshAccount struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
+
+type sshComment struct {
+	Timestamp int64      `json:"timestamp"`
+	Reviewer  sshAccount `json:"reviewer"`
+	Message   string     `json:"message"`
+}
+
+func newGerritSsh(src Source, authMan *authManager) (*gerritSsh, error) {
+	sshUrl, err := url.Parse(src.SshUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh_url: %v", err)
+	}
+	if sshUrl.Scheme != "ssh" || sshUrl.Hostname() == "" {
+		return nil, fmt.Errorf("invalid ssh_url %q: must be like ssh://user@host:29418", src.SshUrl)
+	}
+	return &gerritSsh{url: sshUrl, authMan: authMan}, nil
+}
+
+func (c *gerritSsh) queryChanges(
+	ctx context.Context,
+	query string,
+	opt gerrit.QueryChangesOpt,
+) ([]*changeInfo, error) {
+	sshChanges, err := c.query(ctx, query, opt)
+	if err != nil {
+		return nil, err
+	}
+	var changes []*changeInfo
+	for _, change := range sshChanges {
+		changes = append(changes, change.changeInfo(c.url))
+	}
+	return changes, nil
+}
+
+// query runs a gerrit query command, returning the changes as given.
+func (c *gerritSsh) query(
+	ctx context.Context,
+	query string,
+	opt gerrit.QueryChangesOpt,
+) ([]sshChange, error) {
+	args := []string{"gerrit", "query", "--format=JSON"}
+	for _, field := range opt.Fields {
+		switch field {
+		case "CURRENT_REVISION":
+			args = append(args, "--current-patch-set")
+		case "ALL_REVISIONS":
+			args = append(args, "--patch-sets")
+		case "DETAILED_LABELS":
+			args = append(args, "--all-approvals")
+		case "MESSAGES":
+			args = append(args, "--comments")
+		case "CURRENT_COMMIT", "ALL_COMMITS":
+			args = append(args, "--commit-message")
+		case "CURRENT_FILES", "ALL_FILES":
+			args = append(args, "--files")
+		}
+	}
+	if opt.N != 0 {
+		query = fmt.Sprintf("(%s) limit:%d", query, opt.N)
+	}
+	args = append(args, "--", sshQuote(query))
+
+	output, err := c.run(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []sshChange
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var result struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		}
+		err = json.Unmarshal(scanner.Bytes(), &result)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding query result: %v", err)
+		}
+		if result.Type == "error" {
+			return nil, fmt.Errorf("query failed: %s", result.Message)
+		}
+		// The last line is query statistics.
+		if result.Type != "" {
+			continue
+		}
+
+		var change sshChange
+		err = json.Unmarshal(scanner.Bytes(), &change)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding query result: %v", err)
+		}
+		changes = append(changes, change)
+	}
+	return changes, scanner.Err()
+}
+
+func (c *gerritSsh) getChange(
+	ctx context.Context,
+	changeId string,
+	fields ...string,
+) (*changeInfo, error) {
+	changes, err := c.queryChanges(ctx, changeQuery(changeId),
+		gerrit.QueryChangesOpt{Fields: fields})
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) != 1 {
+		return nil, fmt.Errorf("found %d changes matching %q", len(changes), changeId)
+	}
+	return changes[0], nil
+}
+
+func (c *gerritSsh) getRelatedChanges(
+	ctx context.Context,
+	changeId string,
+	revision string,
+) ([]relatedChangeInfo, error) {
+	return nil, errUnsupportedOverSsh
+}
+
+func (c *gerritSsh) getMergeable(
+	ctx context.Context,
+	changeId string,
+	revision string,
+) (bool, error) {
+	return false, errUnsupportedOverSsh
+}
+
+func (c *gerritSsh) getRevisionLabels(
+	ctx context.Context,
+	changeId string,
+	revision string,
+) (map[string]gerrit.LabelInfo, error) {
+	changes, err := c.query(ctx, changeQuery(changeId),
+		gerrit.QueryChangesOpt{Fields: []string{"ALL_REVISIONS", "DETAILED_LABELS"}})
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) != 1 {
+		return nil, fmt.Errorf("found %d changes matching %q", len(changes), changeId)
+	}
+	for _, ps := range changes[0].PatchSets {
+		if ps.Revision == revision {
+			return ps.labels(), nil
+		}
+	}
+	return nil, fmt.Errorf("no revision %q on change %q", revision, changeId)
+}
+
+func (c *gerritSsh) getComments(
+	ctx context.Context,
+	changeId string,
+) (map[string][]commentInfo, error) {
+	return nil, errUnsupportedOverSsh
+}
+
+func (c *gerritSsh) getRobotComments(
+	ctx context.Context,
+	changeId string,
+) (map[string][]commentInfo, error) {
+	return nil, errUnsupportedOverSsh
+}
+
+func (c *gerritSsh) getSelf(ctx context.Context) (*gerrit.AccountInfo, error) {
+	return nil, errUnsupportedOverSsh
+}
+
+func (c *gerritSsh) getPatch(
+	ctx context.Context,
+	changeId string,
+	revision string,
+) ([]byte, error) {
+	return nil, errUnsupportedOverSsh
+}
+
+func (c *gerritSsh) setReview(
+	ctx context.Context,
+	changeId string,
+	revision string,
+	review reviewInput,
+) error {
+	args := []string{"gerrit", "review"}
+	if project, _, _, ok := splitChangeTriplet(changeId); ok {
+		args = append(args, "--project", sshQuote(project))
+	}
+	message := review.Message
+	comments := make(map[string][]commentInput)
+	for path, pathComments := range review.Comments {
+		comments[path] = append(comments[path], pathComments...)
+	}
+	for path, pathComments := range review.RobotComments {
+		for _, comment := range pathComments {
+			comments[path] = append(comments[path], comment.commentInput)
+		}
+	}
+	if len(comments) > 0 {
+		log.Printf("inline comments are not supported over ssh; adding them to the message")
+		message = appendCommentSummary(message, comments)
+	}
+	if message != "" {
+		args = append(args, "--message", sshQuote(message))
+	}
+	var labels []string
+	for label := range review.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		args = append(args, "--label", fmt.Sprintf("%s=%+d", label, review.Labels[label]))
+	}
+	args = append(args, revision)
+
+	_, err := c.run(ctx, args...)
+	return err
+}
+
+// run runs a Gerrit command over ssh, returning its stdout.
+func (c *gerritSsh) run(ctx context.Context, command ...string) ([]byte, error) {
+	args, err := c.authMan.sshArgs()
+	if err != nil {
+		return nil, err
+	}
+	if port := c.url.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	host := c.url.Hostname()
+	if c.url.User != nil {
+		host = c.url.User.Username() + "@" + host
+	}
+	args = append(args, host)
+	args = append(args, command...)
+
+	log.Printf("ssh %s %v", host, command)
+	output, err := execSsh(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("ssh failed: %v", err)
+	}
+	return output, nil
+}
+
+func realExecSsh(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return output, err
+}
+
+// changeQuery returns a query matching a change ID in any of the forms Gerrit
+// accepts in REST API URLs.
+func changeQuery(changeId string) string {
+	if project, branch, id, ok := splitChangeTriplet(changeId); ok {
+		return fmt.Sprintf("change:%s project:%s branch:%s", id, sshQuote(project), sshQuote(branch))
+	}
+	return "change:" + changeId
+}
+
+// splitChangeTriplet splits a change ID like "<project>~<branch>~<Change-Id>".
+func splitChangeTriplet(changeId string) (project, branch, id string, ok bool) {
+	parts := strings.Split(changeId, "~")
+	if len(parts) != 3 {
+		return
+	}
+	var err error
+	project, err = url.PathUnescape(parts[0])
+	if err != nil {
+		return
+	}
+	branch, err = url.PathUnescape(parts[1])
+	if err != nil {
+		return
+	}
+	return project, branch, parts[2], true
+}
+
+// sshQuote quotes an argument for Gerrit's ssh command line parser.
+func sshQuote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// changeInfo translates a change from an ssh query to its REST API form.
+// Revisions can be fetched with the "ssh" fetch protocol from sshUrl.
+func (sc sshChange) changeInfo(sshUrl *url.URL) *changeInfo {
+	change := &changeInfo{
+		ChangeInfo: gerrit.ChangeInfo{
+			ID: fmt.Sprintf("%s~%s~%s",
+				url.PathEscape(sc.Project), url.PathEscape(sc.Branch), sc.Id),
+			ChangeNumber: sc.Number,
+			Project:      sc.Project,
+			Branch:       sc.Branch,
+			ChangeID:     sc.Id,
+			Subject:      sc.Subject,
+			Status:       sc.Status,
+			Created:      sshTimeStamp(sc.CreatedOn),
+			Updated:      sshTimeStamp(sc.LastUpdated),
+			Owner:        sc.Owner.accountInfo(),
+			Revisions:    make(map[string]gerrit.RevisionInfo),
+		},
+		Topic: sc.Topic,
+	}
+
+	// The current patch set may be given twice.
+	patchSets := make(map[string]sshPatchSet)
+	for _, ps := range append(sc.PatchSets, sc.currentPatchSet()...) {
+		if _, ok := patchSets[ps.Revision]; ok {
+			continue
+		}
+		patchSets[ps.Revision] = ps
+		change.Revisions[ps.Revision] = gerrit.RevisionInfo{
+			PatchSetNumber: ps.Number,
+			Created:        sshTimeStamp(ps.CreatedOn),
+			Uploader:       ps.Uploader.accountInfo(),
+			Ref:            ps.Ref,
+			Fetch: map[string]*gerrit.FetchInfo{
+				"ssh": {
+					URL: fmt.Sprintf("%s/%s", strings.TrimSuffix(sshUrl.String(), "/"), sc.Project),
+					Ref: ps.Ref,
+				},
+			},
+			Files: ps.fileInfos(),
+		}
+		if ps.Number >= change.Revisions[change.CurrentRevision].PatchSetNumber {
+			change.CurrentRevision = ps.Revision
+		}
+	}
+
+	// Commit messages are only given for the current patch set.
+	current, ok := patchSets[change.CurrentRevision]
+	if ok && sc.CommitMessage != "" {
+		commit := &gerrit.CommitInfo{
+			Author:  gerrit.GitPersonInfo{Name: current.Author.Name, Email: current.Author.Email},
+			Subject: sc.Subject,
+			Message: sc.CommitMessage,
+		}
+		for _, parent := range current.Parents {
+			commit.Parents = append(commit.Parents, gerrit.CommitInfo{CommitID: parent})
+		}
+		rev := change.Revisions[change.CurrentRevision]
+		rev.Commit = commit
+		change.Revisions[change.CurrentRevision] = rev
+	}
+
+	// Like REST API labels, only approvals on the current patch set are used.
+	change.Labels = current.labels()
+
+	for _, comment := range sc.Comments {
+		message := gerrit.ChangeMessageInfo{
+			Author:  comment.Reviewer.accountInfo(),
+			Time:    sshTimeStamp(comment.Timestamp),
+			Message: comment.Message,
+		}
+		if match := patchSetMessagePattern.FindStringSubmatch(comment.Message); match != nil {
+			message.RevisionNumber, _ = strconv.Atoi(match[1])
+		}
+		change.Messages = append(change.Messages, message)
+	}
+
+	return change
+}
+
+func (sc sshChange) currentPatchSet() []sshPatchSet {
+	if sc.CurrentPatch == nil {
+		return nil
+	}
+	return []sshPatchSet{*sc.CurrentPatch}
+}
+
+var (
+	// sshFileStatuses maps ssh query file types to REST API file statuses.
+	sshFileStatuses = map[string]string{
+		"ADDED":   "A",
+		"DELETED": "D",
+		"RENAMED": "R",
+		"COPIED":  "C",
+		"REWRITE": "W",
+	}
+)
+
+// labels returns the approvals on the patch set as detailed labels.
+func (ps sshPatchSet) labels() map[string]gerrit.LabelInfo {
+	var labels map[string]gerrit.LabelInfo
+	for _, approval := range ps.Approvals {
+		value, err := strconv.Atoi(approval.Value)
+		if err != nil {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]gerrit.LabelInfo)
+		}
+		label := labels[approval.Type]
+		label.All = append(label.All, gerrit.ApprovalInfo{
+			AccountInfo: *approval.By.accountInfo(),
+			Value:       value,
+			Date:        sshTimeStamp(approval.GrantedOn),
+		})
+		labels[approval.Type] = label
+	}
+	return labels
+}
+
+func (ps sshPatchSet) fileInfos() map[string]*gerrit.FileInfo {
+	if len(ps.Files) == 0 {
+		return nil
+	}
+	files := make(map[string]*gerrit.FileInfo)
+	for _, file := range ps.Files {
+		// Deletions are given as negative numbers.
+		deleted := file.Deletions
+		if deleted < 0 {
+			deleted = -deleted
+		}
+		files[file.File] = &gerrit.FileInfo{
+			Status:        sshFileStatuses[file.Type],
+			OldPath:       file.FileOld,
+			LinesInserted: file.Insertions,
+			LinesDeleted:  deleted,
+		}
+	}
+	return files
+}
+
+func (sa sshAccount) accountInfo() *gerrit.AccountInfo {
+	return &gerrit.AccountInfo{
+		Name:     sa.Name,
+		Email:    sa.Email,
+		Username: sa.Username,
+	}
+}
+
+func sshTimeStamp(seconds int64) gerrit.TimeStamp {
+	return gerrit.TimeStamp(time.Unix(seconds, 0))
+}
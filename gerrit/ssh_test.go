@@ -0,0 +1,463 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/build/gerrit"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+const (
+	testSshUrl = "ssh://ci@gerrit.example.com:29418"
+
+	// testSshServerEnv names the file recording requests to testSshServe.
+	testSshServerEnv = "TEST_GERRIT_SSH_SERVER"
+)
+
+var (
+	testSshLastArgs    []string
+	testSshLastQuery   string
+	testSshLastReview  []string
+	testSshKeyContents string
+	testSshKnownHosts  string
+)
+
+// testExecSsh stands in for ssh to a Gerrit server, serving test changes.
+func testExecSsh(ctx context.Context, args ...string) ([]byte, error) {
+	testSshLastArgs = args
+
+	// Read auth files while they exist.
+	for i, arg := range args {
+		if arg == "-i" {
+			data, _ := ioutil.ReadFile(args[i+1])
+			testSshKeyContents = string(data)
+		}
+		if strings.HasPrefix(arg, "UserKnownHostsFile=") {
+			data, _ := ioutil.ReadFile(strings.TrimPrefix(arg, "UserKnownHostsFile="))
+			testSshKnownHosts = string(data)
+		}
+	}
+
+	cmd := 0
+	for cmd < len(args) && args[cmd] != "gerrit" {
+		cmd++
+	}
+	// ssh sends the command as one line, which Gerrit splits into arguments.
+	return testSshCommand(testSshSplit(strings.Join(args[cmd:], " ")))
+}
+
+// testSshCommand runs a Gerrit ssh command, serving test changes.
+func testSshCommand(command []string) ([]byte, error) {
+	if len(command) < 2 || command[0] != "gerrit" {
+		return nil, fmt.Errorf("unknown command %q", command)
+	}
+	switch command[1] {
+	case "query":
+		return testSshQuery(command[2:])
+	case "review":
+		testSshLastReview = command[2:]
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown command %q", command)
+}
+
+// testSshSplit splits a command line into arguments like Gerrit's ssh daemon.
+func testSshSplit(commandLine string) []string {
+	var args []string
+	var arg []rune
+	var inQuote, inDoubleQuote bool
+	line := []rune(commandLine)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case (c == ' ' || c == '\t') && !inQuote && !inDoubleQuote:
+			if len(arg) > 0 {
+				args = append(args, string(arg))
+				arg = nil
+			}
+		case c == '"' && !inQuote:
+			inDoubleQuote = !inDoubleQuote
+		case c == '\'' && !inDoubleQuote:
+			inQuote = !inQuote
+		case c == '\\' && !inQuote && i+1 < len(line):
+			i++
+			arg = append(arg, line[i])
+		default:
+			arg = append(arg, c)
+		}
+	}
+	if len(arg) > 0 {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+// testSshRequest is a request received by testSshServe.
+type testSshRequest struct {
+	Host       string
+	Port       string
+	Options    []string
+	Identity   string
+	KnownHosts string
+	Command    []string
+}
+
+// testSshServe stands in for both the ssh client and the Gerrit server when
+// testRealSsh runs the test binary as ssh. It parses the client's arguments,
+// records the request in the file named by testSshServerEnv and serves the
+// command from testSshCommand.
+//
+// An SSH server in the test would need golang.org/x/crypto/ssh, which isn't
+// vendored, so the transport itself and host key verification aren't
+// exercised; the client's arguments, including the host key options and the
+// known hosts and identity files, are checked instead.
+func testSshServe(args []string) int {
+	var req testSshRequest
+	for len(args) > 1 && strings.HasPrefix(args[0], "-") {
+		value := args[1]
+		switch args[0] {
+		case "-o":
+			req.Options = append(req.Options, value)
+			if strings.HasPrefix(value, "UserKnownHostsFile=") {
+				data, err := ioutil.ReadFile(strings.TrimPrefix(value, "UserKnownHostsFile="))
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return 255
+				}
+				req.KnownHosts = string(data)
+			}
+		case "-i":
+			data, err := ioutil.ReadFile(value)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 255
+			}
+			req.Identity = string(data)
+		case "-p":
+			req.Port = value
+		default:
+			fmt.Fprintf(os.Stderr, "unknown option %s\n", args[0])
+			return 255
+		}
+		args = args[2:]
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: ssh [options] host command")
+		return 255
+	}
+	req.Host = args[0]
+	req.Command = testSshSplit(strings.Join(args[1:], " "))
+
+	data, err := json.Marshal(req)
+	if err == nil {
+		err = ioutil.WriteFile(os.Getenv(testSshServerEnv), data, 0600)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 255
+	}
+
+	output, err := testSshCommand(req.Command)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(output)
+	return 0
+}
+
+// testRealSsh makes execSsh run the test binary as ssh, serving commands with
+// testSshServe. It returns a func reading the last request and a func undoing
+// the change.
+func testRealSsh(t *testing.T) (func() testSshRequest, func()) {
+	binary, err := os.Executable()
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir(testTempDir, "ssh")
+	assert.NoError(t, err)
+	requestPath := filepath.Join(dir, "request.json")
+	script := fmt.Sprintf("#!/bin/sh\nexec env %s=%s %s \"$@\"\n",
+		testSshServerEnv, shellQuote(requestPath), shellQuote(binary))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0755))
+
+	origPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+origPath)
+	execSsh = realExecSsh
+
+	lastRequest := func() testSshRequest {
+		var req testSshRequest
+		data, err := ioutil.ReadFile(requestPath)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(data, &req))
+		return req
+	}
+	return lastRequest, func() {
+		os.Setenv("PATH", origPath)
+		execSsh = testExecSsh
+	}
+}
+
+func testSshQuery(args []string) ([]byte, error) {
+	revisionCount := 0
+	withFiles := false
+	var query string
+	for i, arg := range args {
+		switch arg {
+		case "--current-patch-set":
+			revisionCount = 1
+		case "--patch-sets":
+			revisionCount = 3
+		case "--files":
+			withFiles = true
+		case "--":
+			query = args[i+1]
+		}
+	}
+	testSshLastQuery = query
+
+	var changes []gerrit.ChangeInfo
+	if strings.HasPrefix(query, "change:") {
+		testNumber, ok := testParseChangeId(strings.Fields(query)[0][len("change:"):])
+		if ok {
+			changes = append(changes, testBuildChange(testNumber, revisionCount))
+		}
+	} else {
+		n := 3
+		if strings.HasSuffix(query, " limit:1") {
+			n = 1
+		}
+		for i := n; i > 0; i-- {
+			changes = append(changes, testBuildChange(i, revisionCount))
+		}
+	}
+
+	var output bytes.Buffer
+	encoder := json.NewEncoder(&output)
+	for _, change := range changes {
+		if withFiles {
+			for revision, rev := range change.Revisions {
+				rev.Files = testFiles
+				change.Revisions[revision] = rev
+			}
+		}
+		err := encoder.Encode(testSshChange(change))
+		if err != nil {
+			return nil, err
+		}
+	}
+	encoder.Encode(map[string]interface{}{"type": "stats", "rowCount": len(changes)})
+	return output.Bytes(), nil
+}
+
+// testSshChange translates a REST API test change to its ssh query form.
+func testSshChange(change gerrit.ChangeInfo) sshChange {
+	sc := sshChange{
+		Project:     change.Project,
+		Branch:      change.Branch,
+		Id:          change.ChangeID,
+		Number:      change.ChangeNumber,
+		Subject:     change.Subject,
+		LastUpdated: change.Updated.Time().Unix(),
+		Status:      "NEW",
+	}
+	for revision, rev := range change.Revisions {
+		ps := sshPatchSet{
+			Number:    rev.PatchSetNumber,
+			Revision:  revision,
+			Ref:       rev.Ref,
+			CreatedOn: rev.Created.Time().Unix(),
+			Uploader:  sshAccount{Name: rev.Uploader.Name, Email: rev.Uploader.Email},
+		}
+		for path, file := range rev.Files {
+			fileType := "MODIFIED"
+			for t, status := range sshFileStatuses {
+				if status == file.Status {
+					fileType = t
+				}
+			}
+			ps.Files = append(ps.Files, sshFile{
+				File:       path,
+				FileOld:    file.OldPath,
+				Type:       fileType,
+				Insertions: file.LinesInserted,
+				Deletions:  -file.LinesDeleted,
+			})
+		}
+		for label, labelInfo := range testRevisionLabels(change, revision) {
+			for _, approval := range labelInfo.All {
+				ps.Approvals = append(ps.Approvals, sshApproval{
+					Type:      label,
+					Value:     strconv.Itoa(approval.Value),
+					GrantedOn: approval.Date.Time().Unix(),
+					By:        sshAccount{Username: approval.Username},
+				})
+			}
+		}
+		if revision == change.CurrentRevision {
+			sc.CommitMessage = rev.Commit.Message
+			sc.CurrentPatch = &ps
+		}
+		sc.PatchSets = append(sc.PatchSets, ps)
+	}
+	return sc
+}
+
+func TestSshCheckWithoutVersion(t *testing.T) {
+	versions := testCheck(t, Source{SshUrl: testSshUrl}, Version{})
+	assert.Equal(t, "(status:open) limit:1", testSshLastQuery)
+	assert.Contains(t, testSshLastArgs, "ci@gerrit.example.com")
+	assert.Contains(t, testSshLastArgs, "29418")
+
+	assert.Len(t, versions, 1)
+	assert.Equal(t, "testproject~testbranch~Itestchange1", versions[0].ChangeId)
+	assert.Equal(t, "deadbeef0", versions[0].Revision)
+	assert.True(t, time.Unix(100, 0).Equal(versions[0].Created))
+}
+
+func TestSshCheckWithNewVersions(t *testing.T) {
+	versions := testCheck(t, Source{SshUrl: testSshUrl}, Version{
+		ChangeId: "testproject~testbranch~Itestchange1",
+		Revision: "deadbeef0",
+		Created:  time.Unix(1, 0),
+	})
+	assert.Len(t, versions, 9)
+}
+
+func TestSshCheckSkipIfVoted(t *testing.T) {
+	versions := testCheck(t, Source{
+		SshUrl:      testSshUrl,
+		SkipIfVoted: SkipIfVoted{Label: "Verified", Account: testCIUsername},
+	}, Version{
+		ChangeId: "testproject~testbranch~Itestchange1",
+		Revision: "deadbeef0",
+		Created:  time.Unix(1, 0),
+	})
+	// Current revisions of changes 1 and 2, and first revisions of changes 2
+	// and 3
+	assert.Len(t, versions, 5)
+}
+
+func TestSshCheckAuthFiles(t *testing.T) {
+	testCheck(t, Source{
+		SshUrl:     testSshUrl,
+		PrivateKey: "my private key",
+		KnownHosts: "gerrit.example.com ssh-ed25519 AAAA",
+	}, Version{})
+	assert.Equal(t, "my private key\n", testSshKeyContents)
+	assert.Equal(t, "gerrit.example.com ssh-ed25519 AAAA", testSshKnownHosts)
+	assert.Contains(t, testSshLastArgs, "StrictHostKeyChecking=yes")
+
+	// Auth files should be deleted
+	for i, arg := range testSshLastArgs {
+		if arg == "-i" {
+			_, err := os.Stat(testSshLastArgs[i+1])
+			assert.True(t, os.IsNotExist(err), "%s wasn't deleted", testSshLastArgs[i+1])
+		}
+	}
+}
+
+func TestSshOut(t *testing.T) {
+	testOut(t, Source{SshUrl: testSshUrl}, outParams{
+		Message: `say "hi"`,
+		Labels:  map[string]int{"Verified": 1, "Code-Review": -1},
+	})
+	assert.Equal(t, []string{
+		"--message", `say "hi"`,
+		"--label", "Code-Review=-1",
+		"--label", "Verified=+1",
+		"outRev",
+	}, testSshLastReview)
+}
+
+func TestSshInFiles(t *testing.T) {
+	testIn(t, Source{SshUrl: testSshUrl}, Version{
+		ChangeId: "testproject~testbranch~Itestchange1",
+		Revision: "deadbeef0",
+	}, inParams{})
+	assert.Contains(t, testSshLastArgs, "--files")
+
+	var files []changedFile
+	data, err := ioutil.ReadFile(testResourceFile(filesFilename))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &files))
+	assert.Contains(t, files, changedFile{Path: "main.go", Status: "M", LinesInserted: 3, LinesDeleted: 1})
+	assert.Contains(t, files, changedFile{Path: "new.go", Status: "R", OldPath: "old.go", LinesInserted: 2})
+
+	// Patches can't be downloaded over ssh.
+	_, err = os.Stat(testResourceFile(patchFilename))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSshOutComments(t *testing.T) {
+	err := testOutComments(t, Source{SshUrl: testSshUrl},
+		`[{"path": "main.go", "line": 3, "message": "Typo"}]`, outParams{Message: "Lint"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"--message", "Lint\n\nmain.go:3: Typo",
+		"deadbeef0",
+	}, testSshLastReview)
+}
+
+func TestSshRealClient(t *testing.T) {
+	lastRequest, restore := testRealSsh(t)
+	defer restore()
+	src := Source{
+		SshUrl:     testSshUrl,
+		PrivateKey: "my private key",
+		KnownHosts: "gerrit.example.com ssh-ed25519 AAAA",
+	}
+
+	versions := testCheck(t, src, Version{})
+	assert.Len(t, versions, 1)
+	req := lastRequest()
+	assert.Equal(t, "ci@gerrit.example.com", req.Host)
+	assert.Equal(t, "29418", req.Port)
+	assert.Contains(t, req.Options, "StrictHostKeyChecking=yes")
+	assert.Equal(t, "my private key\n", req.Identity)
+	assert.Equal(t, "gerrit.example.com ssh-ed25519 AAAA", req.KnownHosts)
+	assert.Equal(t, []string{
+		"gerrit", "query", "--format=JSON", "--current-patch-set", "--", "(status:open) limit:1",
+	}, req.Command)
+
+	message := "it's \"quoted\" \\ $HOME\n\n  indented"
+	testOut(t, src, outParams{Message: message, Labels: map[string]int{"Verified": 1}})
+	assert.Equal(t, []string{
+		"gerrit", "review", "--message", message, "--label", "Verified=+1", "outRev",
+	}, lastRequest().Command)
+}
+
+func TestSshChangeQuery(t *testing.T) {
+	assert.Equal(t, `change:I1 project:"my/project" branch:"main"`,
+		changeQuery("my%2Fproject~main~I1"))
+	assert.Equal(t, "change:123", changeQuery("123"))
+}
+
+func TestSshInvalidUrl(t *testing.T) {
+	req := testRequest{Source: Source{SshUrl: "https://gerrit.example.com"}}
+	assert.Error(t, resource.TestCheckFunc(t, req, nil, check))
+}
@@ -0,0 +1,218 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// Files which may hold the system's CA certificates, as searched by
+	// crypto/x509 on Linux. SSL_CERT_FILE overrides them.
+	systemCaFiles = []string{
+		"/etc/ssl/certs/ca-certificates.crt",
+		"/etc/pki/tls/certs/ca-bundle.crt",
+		"/etc/ssl/ca-bundle.pem",
+		"/etc/pki/tls/cacert.pem",
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+		"/etc/ssl/cert.pem",
+	}
+)
+
+// httpTransport returns an HTTP transport using the configured CA
+// certificates, client certificate and proxy.
+func (am *authManager) httpTransport() (*http.Transport, error) {
+	tlsConfig := &tls.Config{}
+
+	if am.caCerts != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(am.caCerts)) {
+			return nil, errors.New("no valid certificates in ca_certs")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if am.clientCert != "" || am.clientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(am.clientCert), []byte(am.clientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client_cert or client_key: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if am.proxy != "" {
+		proxyUrl, err := url.Parse(am.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %v", err)
+		}
+		proxy = func(req *http.Request) (*url.URL, error) {
+			if am.bypassProxy(req.URL.Host) {
+				return nil, nil
+			}
+			return proxyUrl, nil
+		}
+	}
+
+	// Settings other than TLS and proxy match http.DefaultTransport.
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}, nil
+}
+
+// bypassProxy reports whether host (with an optional port) matches no_proxy.
+// no_proxy is a comma separated list of host names, which also match their
+// subdomains, or "*" to match every host.
+func (am *authManager) bypassProxy(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, entry := range strings.Split(am.noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		if entry == "" {
+			continue
+		}
+		if entry == "*" || host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// caCertsPath returns the path of a file with the system's CA certificates
+// followed by the configured ones, or "" if none are configured.
+func (am *authManager) caCertsPath() (string, error) {
+	if am.caCerts == "" {
+		return "", nil
+	}
+	var err error
+	if am.caCertsPath_ == "" {
+		certs := systemCaCerts()
+		if certs == "" {
+			log.Printf("system CA certificates not found; git will only trust ca_certs")
+		} else if !strings.HasSuffix(certs, "\n") {
+			certs += "\n"
+		}
+		am.caCertsPath_, err = writeAuthTempFile("concourse-gerrit-ca-certs", certs+am.caCerts)
+	}
+	return am.caCertsPath_, err
+}
+
+// systemCaCerts returns the contents of the system's CA certificates file, or
+// "" if it isn't found.
+func systemCaCerts() string {
+	files := systemCaFiles
+	if file := os.Getenv("SSL_CERT_FILE"); file != "" {
+		files = []string{file}
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			return string(data)
+		}
+	}
+	return ""
+}
+
+func (am *authManager) clientCertPath() (string, error) {
+	if am.clientCert == "" {
+		return "", nil
+	}
+	var err error
+	if am.clientCertPath_ == "" {
+		am.clientCertPath_, err = writeAuthTempFile("concourse-gerrit-client-cert", am.clientCert)
+	}
+	return am.clientCertPath_, err
+}
+
+func (am *authManager) clientKeyPath() (string, error) {
+	if am.clientKey == "" {
+		return "", nil
+	}
+	var err error
+	if am.clientKeyPath_ == "" {
+		am.clientKeyPath_, err = writeAuthTempFile("concourse-gerrit-client-key", am.clientKey)
+	}
+	return am.clientKeyPath_, err
+}
+
+// gitTlsConfigArgs returns git config settings for the configured CA
+// certificates, client certificate and proxy when fetching from fetchUrl.
+func (am *authManager) gitTlsConfigArgs(fetchUrl string) (map[string]string, error) {
+	args := make(map[string]string)
+
+	// git only trusts http.sslCAInfo, so it includes the system's certificates
+	// like the REST client's pool.
+	caCertsPath, err := am.caCertsPath()
+	if err != nil {
+		return nil, err
+	}
+	if caCertsPath != "" {
+		args["http.sslCAInfo"] = caCertsPath
+	}
+
+	clientCertPath, err := am.clientCertPath()
+	if err != nil {
+		return nil, err
+	}
+	if clientCertPath != "" {
+		args["http.sslCert"] = clientCertPath
+	}
+
+	clientKeyPath, err := am.clientKeyPath()
+	if err != nil {
+		return nil, err
+	}
+	if clientKeyPath != "" {
+		args["http.sslKey"] = clientKeyPath
+	}
+
+	if am.proxy != "" {
+		u, err := url.Parse(fetchUrl)
+		if err == nil && !am.bypassProxy(u.Host) {
+			args["http.proxy"] = am.proxy
+		}
+	}
+
+	return args, nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/google/concourse-resources/internal/resource"
+)
+
+// testCertificate generates a self-signed certificate and key, PEM encoded.
+func testCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "testclient"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+func testServerCaCerts(server *httptest.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}))
+}
+
+func testCheckUrl(t *testing.T, src Source) error {
+	req := testRequest{Source: src}
+	return resource.TestCheckFunc(t, req, nil, check)
+}
+
+func TestCheckCaCerts(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(testGerritHandler))
+	defer server.Close()
+
+	assert.Error(t, testCheckUrl(t, Source{Url: server.URL}))
+	assert.NoError(t, testCheckUrl(t, Source{
+		Url:     server.URL,
+		CaCerts: testServerCaCerts(server),
+	}))
+}
+
+func TestCheckInvalidCaCerts(t *testing.T) {
+	err := testCheckUrl(t, Source{Url: testGerritUrl, CaCerts: "not a certificate"})
+	assert.Error(t, err)
+}
+
+func TestCheckClientCert(t *testing.T) {
+	clientCert, clientKey := testCertificate(t)
+	var peerCerts []*x509.Certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			peerCerts = r.TLS.PeerCertificates
+			testGerritHandler(w, r)
+		}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	assert.NoError(t, testCheckUrl(t, Source{
+		Url:        server.URL,
+		CaCerts:    testServerCaCerts(server),
+		ClientCert: clientCert,
+		ClientKey:  clientKey,
+	}))
+	if assert.Len(t, peerCerts, 1) {
+		assert.Equal(t, "testclient", peerCerts[0].Subject.CommonName)
+	}
+}
+
+func TestCheckProxy(t *testing.T) {
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			proxiedHost = r.Host
+			testGerritHandler(w, r)
+		}))
+	defer proxy.Close()
+
+	assert.NoError(t, testCheckUrl(t, Source{Url: testGerritUrl, Proxy: proxy.URL}))
+	assert.Equal(t, testGerritUrl, "http://"+proxiedHost)
+
+	proxiedHost = ""
+	assert.NoError(t, testCheckUrl(t, Source{
+		Url:     testGerritUrl,
+		Proxy:   proxy.URL,
+		NoProxy: "example.com, localhost",
+	}))
+	assert.Equal(t, "", proxiedHost)
+}
+
+func TestBypassProxy(t *testing.T) {
+	am := &authManager{noProxy: "example.com,.internal:8080"}
+	assert.True(t, am.bypassProxy("example.com"))
+	assert.True(t, am.bypassProxy("gerrit.example.com:443"))
+	assert.True(t, am.bypassProxy("review.internal"))
+	assert.False(t, am.bypassProxy("notexample.com"))
+	assert.False(t, am.bypassProxy("internal.example.org"))
+
+	am.noProxy = "*"
+	assert.True(t, am.bypassProxy("anything"))
+}
+
+func TestInGitTls(t *testing.T) {
+	clientCert, clientKey := testCertificate(t)
+	caCerts := clientCert
+	systemCerts, _ := testCertificate(t)
+	systemCertsPath := filepath.Join(testTempDir, "system-ca-certs.pem")
+	assert.NoError(t, ioutil.WriteFile(systemCertsPath, []byte(systemCerts), 0600))
+	os.Setenv("SSL_CERT_FILE", systemCertsPath)
+	defer os.Unsetenv("SSL_CERT_FILE")
+
+	gitConfig := make(map[string]string)
+	var paths []string
+	for _, key := range []string{"http.sslCAInfo", "http.sslCert", "http.sslKey"} {
+		key := key
+		mockGitWithArg(key, func(args []string, idx int) {
+			paths = append(paths, args[idx+1])
+			data, err := ioutil.ReadFile(args[idx+1])
+			assert.NoError(t, err)
+			gitConfig[key] = string(data)
+		})
+	}
+	mockGitWithArg("http.proxy", func(args []string, idx int) {
+		gitConfig["http.proxy"] = args[idx+1]
+	})
+
+	testIn(t, Source{
+		CaCerts:    caCerts,
+		ClientCert: clientCert,
+		ClientKey:  clientKey,
+		Proxy:      "http://proxy.example.com:3128",
+		NoProxy:    "localhost",
+	}, testInVersion, inParams{FetchUrl: "http://gerrit.example.com/testproject"})
+	assert.Equal(t, map[string]string{
+		"http.sslCAInfo": systemCerts + caCerts,
+		"http.sslCert":   clientCert,
+		"http.sslKey":    clientKey,
+		"http.proxy":     "http://proxy.example.com:3128",
+	}, gitConfig)
+
+	// Temp files should be deleted
+	assert.Len(t, paths, 3)
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), "%s wasn't deleted", path)
+	}
+}